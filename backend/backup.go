@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxBackups is how many previous versions of a file Save keeps around
+var maxBackups = 5
+
+// backupDirName is the directory, next to the saved file, holding its backups
+const backupDirName = ".backups"
+
+// BackupInfo describes one rotated backup; Index 1 is the most recent
+type BackupInfo struct {
+	Index   int       `json:"index"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// backupPath returns the path of backup n for the file at path
+func backupPath(path string, n int) string {
+	return filepath.Join(filepath.Dir(path), backupDirName, fmt.Sprintf("%s.%d", filepath.Base(path), n))
+}
+
+// writeFileAtomic writes a file through a temporary file in the same
+// directory, syncs it and renames it over path, so readers see either the old
+// or the new contents and never a partial write. The current contents are
+// rotated into up to keep backups right before the rename.
+func writeFileAtomic(path string, keep int, write func(w io.Writer) error) (err error) {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if err = write(tmp); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+
+	if err = rotateBackups(path, keep); err != nil {
+		return fmt.Errorf("error rotating backups: %v", err)
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// Persist the rename itself; not every platform supports syncing a directory
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// rotateBackups shifts the existing backups of path by one, dropping the
+// oldest, and copies the current file into backup 1
+func rotateBackups(path string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Join(filepath.Dir(path), backupDirName), 0755); err != nil {
+		return err
+	}
+	os.Remove(backupPath(path, keep))
+	for n := keep - 1; n >= 1; n-- {
+		err := os.Rename(backupPath(path, n), backupPath(path, n+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.WriteFile(backupPath(path, 1), data, 0644)
+}
+
+// listBackups returns the backups available for path, newest first
+func listBackups(path string) ([]BackupInfo, error) {
+	entries, err := os.ReadDir(filepath.Join(filepath.Dir(path), backupDirName))
+	if os.IsNotExist(err) {
+		return []BackupInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := filepath.Base(path) + "."
+	backups := []BackupInfo{}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), prefix) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(entry.Name(), prefix))
+		if err != nil || n < 1 {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		backups = append(backups, BackupInfo{Index: n, Size: info.Size(), ModTime: info.ModTime()})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Index < backups[j].Index })
+	return backups, nil
+}
+
+// removeBackups deletes every backup of path
+func removeBackups(path string) error {
+	backups, err := listBackups(path)
+	if err != nil {
+		return err
+	}
+	for _, backup := range backups {
+		if err := os.Remove(backupPath(path, backup.Index)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreBackup atomically replaces path with backup n. The replaced
+// contents become backup 1, so a restore can itself be undone.
+func restoreBackup(path string, n, keep int) error {
+	data, err := os.ReadFile(backupPath(path, n))
+	if err != nil {
+		return err
+	}
+
+	if err := checkBackup(data, n); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, keep, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// checkBackup makes sure backup n is still a readable archive before it's
+// restored
+func checkBackup(data []byte, n int) error {
+	if _, err := NewNitroReader(bytes.NewReader(data)).ReadArchive(); err != nil {
+		return fmt.Errorf("backup %d is not a valid .nitro file: %w", n, err)
+	}
+	return nil
+}
+
+// getNitroBackups lists the backups kept for a .nitro file
+func getNitroBackups(c *gin.Context) {
+	ws := requestWorkspace(c)
+	if ws == nil {
+		return
+	}
+
+	filename := c.Param("filename")
+	if filepath.Ext(filename) != ".nitro" {
+		filename = filename + ".nitro"
+	}
+
+	backupStore, ok := ws.Store.(BackupStore)
+	if !ok {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Backups are not supported by this store"})
+		return
+	}
+	if _, err := ws.Store.Stat(filename); err != nil {
+		c.JSON(nitroErrorStatus(err), gin.H{"error": "Error listing backups: " + err.Error()})
+		return
+	}
+
+	backups, err := backupStore.Backups(filename)
+	if err != nil {
+		c.JSON(nitroErrorStatus(err), gin.H{"error": "Error listing backups: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"filename": filename, "backups": backups})
+}
+
+// restoreNitroBackup replaces a .nitro file with one of its backups
+func restoreNitroBackup(c *gin.Context) {
+	ws := requestWorkspace(c)
+	if ws == nil {
+		return
+	}
+
+	filename := c.Param("filename")
+	if filepath.Ext(filename) != ".nitro" {
+		filename = filename + ".nitro"
+	}
+
+	index, err := strconv.Atoi(c.Param("index"))
+	if err != nil || index < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid backup index"})
+		return
+	}
+
+	backupStore, ok := ws.Store.(BackupStore)
+	if !ok {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Backups are not supported by this store"})
+		return
+	}
+
+	log.Printf("[DEBUG] restoreNitroBackup: restoring backup %d of %s", index, filename)
+	unlock := ws.lockFiles(filename)
+	defer unlock()
+	if err := ws.History.EnsureBaseline(filename); err != nil {
+		log.Printf("[ERROR] restoreNitroBackup: error recording baseline revision: %v", err)
+	}
+	err = backupStore.RestoreBackup(filename, index)
+	renderCache.Invalidate(ws, filename)
+	if err != nil {
+		log.Printf("[ERROR] restoreNitroBackup: %v", err)
+		c.JSON(nitroErrorStatus(err), gin.H{"error": "Error restoring backup: " + err.Error()})
+		return
+	}
+	if _, err := ws.History.Record(filename, requestAuthor(c), fmt.Sprintf("restore backup %d", index)); err != nil {
+		log.Printf("[ERROR] restoreNitroBackup: error recording revision: %v", err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Backup restored successfully", "filename": filename})
+}
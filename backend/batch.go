@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxRenderWorkers bounds how many GIFs one batch renders at the same time
+var maxRenderWorkers = 4
+
+// maxBatchRenders caps the combinations a single batch may ask for
+const maxBatchRenders = 512
+
+// BatchRenderRequest asks for every combination of the given directions,
+// states and colors. Empty lists default to all the values the furni has,
+// and a zero size to its largest visualization.
+type BatchRenderRequest struct {
+	Filename   string `json:"filename"`
+	Size       int    `json:"size"`
+	Directions []int  `json:"directions,omitempty"`
+	States     []int  `json:"states,omitempty"`
+	Colors     []int  `json:"colors,omitempty"`
+	Format     string `json:"format,omitempty"`
+}
+
+// BatchRenderResult is one entry of the batch manifest
+type BatchRenderResult struct {
+	Direction int    `json:"direction"`
+	State     int    `json:"state"`
+	Color     int    `json:"color"`
+	URL       string `json:"url,omitempty"`
+	GifURL    string `json:"gif_url,omitempty"`
+	// UsedDirection differs from Direction when the render fell back
+	UsedDirection *int     `json:"used_direction,omitempty"`
+	Warnings      []string `json:"warnings,omitempty"`
+	Error         string   `json:"error,omitempty"`
+}
+
+// uniqueInts returns values without duplicates, keeping their order
+func uniqueInts(values []int) []int {
+	seen := make(map[int]bool, len(values))
+	unique := make([]int, 0, len(values))
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
+	}
+	return unique
+}
+
+// renderBatch renders several combinations of one furni with a bounded pool
+// of workers. Failed combinations are reported in the manifest next to the
+// rendered ones instead of failing the whole request.
+func renderBatch(c *gin.Context) {
+	ws := requestWorkspace(c)
+	if ws == nil {
+		return
+	}
+
+	var req BatchRenderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		log.Printf("[ERROR] renderBatch: error binding JSON: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	filename := req.Filename
+	if !strings.HasSuffix(filename, ".nitro") {
+		filename += ".nitro"
+	}
+
+	// Read the file once for both the available values and the renders
+	data, err := ws.Store.Get(filename)
+	if err != nil {
+		c.JSON(nitroErrorStatus(err), gin.H{"error": "Error loading .nitro file: " + err.Error()})
+		return
+	}
+	info, err := processNitroData(filename, data)
+	if err != nil {
+		c.JSON(nitroErrorStatus(err), gin.H{"error": "Error processing file: " + err.Error()})
+		return
+	}
+	furni, err := readNitroFurni(data)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error loading furni JSON: " + err.Error()})
+		return
+	}
+	lib, err := loadFurniLibrary(data)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error loading furni library: " + err.Error()})
+		return
+	}
+
+	format, err := renderFormat(req.Format)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	size := req.Size
+	if size == 0 {
+		size = info.Size
+	}
+	directions, states, colors := req.Directions, req.States, req.Colors
+	if len(directions) == 0 {
+		directions = info.Directions
+	}
+	if len(states) == 0 {
+		states = info.States
+	}
+	if len(colors) == 0 {
+		colors = info.Colors
+	}
+	directions, states, colors = uniqueInts(directions), uniqueInts(states), uniqueInts(colors)
+
+	total := len(directions) * len(states) * len(colors)
+	if total > maxBatchRenders {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Too many combinations: %d, the limit is %d", total, maxBatchRenders)})
+		return
+	}
+
+	results := make([]BatchRenderResult, 0, total)
+	for _, direction := range directions {
+		for _, state := range states {
+			for _, color := range colors {
+				results = append(results, BatchRenderResult{Direction: direction, State: state, Color: color})
+			}
+		}
+	}
+	log.Printf("[DEBUG] renderBatch: rendering %d combinations of %s at size %d", total, filename, size)
+
+	// Each worker fills in the results it takes from the queue
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < maxRenderWorkers && w < total; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				result := &results[i]
+				render := RenderRequest{
+					Filename:  req.Filename,
+					Direction: result.Direction,
+					State:     result.State,
+					Size:      size,
+					Color:     result.Color,
+					Format:    format,
+				}
+				key := renderKey(ws, data, render)
+				output, ok := renderCache.Get(key)
+				if !ok {
+					var err error
+					output, err = renderLibrary(ws, lib, furni, render, key)
+					if err != nil {
+						result.Error = err.Error()
+						continue
+					}
+					renderCache.Add(key, output, renderOwner(ws, filename))
+				}
+				result.URL = "/static/" + output.Filename
+				if output.Format == formatGIF {
+					result.GifURL = result.URL
+				}
+				if output.Direction != result.Direction {
+					direction := output.Direction
+					result.UsedDirection = &direction
+				}
+				result.Warnings = output.Warnings
+			}
+		}()
+	}
+	for i := range results {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	failed := 0
+	for _, result := range results {
+		if result.Error != "" {
+			failed++
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"filename": filename,
+		"size":     size,
+		"rendered": total - failed,
+		"failed":   failed,
+		"results":  results,
+	})
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// renderCacheSize caps the bytes kept in ../static before the least
+// recently used renders are evicted
+var renderCacheSize int64 = 256 << 20
+
+// renderCache tracks everything rendered to ../static
+var renderCache = NewRenderCache("../static", renderCacheSize)
+
+// RenderCache keeps rendered files in a directory, keyed by a hash of the
+// archive contents and the render parameters. File names include the key,
+// so a changed furni gets new URLs and served files never go stale.
+type RenderCache struct {
+	Dir      string
+	MaxBytes int64
+
+	mu     sync.Mutex
+	byKey  map[string]*cacheEntry
+	byFile map[string]*cacheEntry
+	lru    *list.List // front is the most recently used
+	size   int64
+}
+
+type cacheEntry struct {
+	key    string
+	owners []string // workspace ID and stored file names the render was made from
+	output RenderOutput
+	files  []string
+	size   int64
+	elem   *list.Element
+}
+
+func NewRenderCache(dir string, maxBytes int64) *RenderCache {
+	return &RenderCache{
+		Dir:      dir,
+		MaxBytes: maxBytes,
+		byKey:    make(map[string]*cacheEntry),
+		byFile:   make(map[string]*cacheEntry),
+		lru:      list.New(),
+	}
+}
+
+// renderKey hashes the contents of an archive with the render parameters
+// and the workspace it was rendered for. params is encoded as JSON, so every
+// field of a request is part of the key.
+func renderKey(ws *Workspace, data []byte, params interface{}) string {
+	p, _ := json.Marshal(params)
+	sum := sha256.Sum256(data)
+	h := sha256.New()
+	h.Write([]byte(ws.ID))
+	h.Write(sum[:])
+	h.Write(p)
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// renderOwner identifies a stored file for invalidation
+func renderOwner(ws *Workspace, filename string) string {
+	return ws.ID + "/" + filename
+}
+
+// Load adopts the files already in Dir, oldest first in line for eviction.
+// They can't be matched to a key any more, so they are never served as hits.
+func (rc *RenderCache) Load() error {
+	dirEntries, err := os.ReadDir(rc.Dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	type found struct {
+		name string
+		info os.FileInfo
+	}
+	var files []found
+	for _, entry := range dirEntries {
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, found{entry.Name(), info})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].info.ModTime().After(files[j].info.ModTime()) })
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for _, f := range files {
+		if _, ok := rc.byFile[f.name]; ok {
+			continue
+		}
+		entry := &cacheEntry{files: []string{f.name}, size: f.info.Size()}
+		entry.elem = rc.lru.PushBack(entry)
+		rc.byFile[f.name] = entry
+		rc.size += entry.size
+	}
+	rc.evict()
+	return nil
+}
+
+// Get returns the render cached under key, if its files are still there
+func (rc *RenderCache) Get(key string) (*RenderOutput, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	entry, ok := rc.byKey[key]
+	if !ok {
+		return nil, false
+	}
+	for _, name := range entry.files {
+		if _, err := os.Stat(filepath.Join(rc.Dir, name)); err != nil {
+			rc.remove(entry)
+			return nil, false
+		}
+	}
+	rc.lru.MoveToFront(entry.elem)
+	output := entry.output
+	return &output, true
+}
+
+// Add records a render written to Dir from the stored files of owners (see
+// renderOwner) and evicts old renders over MaxBytes
+func (rc *RenderCache) Add(key string, output *RenderOutput, owners ...string) {
+	files := []string{output.Filename}
+	if output.TimingFile != "" {
+		files = append(files, output.TimingFile)
+	}
+	var size int64
+	for _, name := range files {
+		if info, err := os.Stat(filepath.Join(rc.Dir, name)); err == nil {
+			size += info.Size()
+		}
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if old, ok := rc.byKey[key]; ok {
+		rc.forget(old)
+	}
+	for _, name := range files {
+		// The file was just rewritten under the same name
+		if old, ok := rc.byFile[name]; ok {
+			rc.forget(old)
+		}
+	}
+	entry := &cacheEntry{key: key, owners: owners, output: *output, files: files, size: size}
+	entry.elem = rc.lru.PushFront(entry)
+	rc.byKey[key] = entry
+	for _, name := range files {
+		rc.byFile[name] = entry
+	}
+	rc.size += size
+	rc.evict()
+}
+
+// Invalidate removes every render made from a stored file
+func (rc *RenderCache) Invalidate(ws *Workspace, filename string) {
+	owner := renderOwner(ws, filename)
+	rc.removeWhere(func(entry *cacheEntry) bool {
+		for _, o := range entry.owners {
+			if o == owner {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// InvalidateWorkspace removes every render made from a workspace
+func (rc *RenderCache) InvalidateWorkspace(ws *Workspace) {
+	prefix := ws.ID + "/"
+	rc.removeWhere(func(entry *cacheEntry) bool {
+		for _, o := range entry.owners {
+			if strings.HasPrefix(o, prefix) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (rc *RenderCache) removeWhere(match func(entry *cacheEntry) bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for e := rc.lru.Front(); e != nil; {
+		next := e.Next()
+		if entry := e.Value.(*cacheEntry); match(entry) {
+			rc.remove(entry)
+		}
+		e = next
+	}
+}
+
+// evict removes the least recently used renders until the cache fits
+func (rc *RenderCache) evict() {
+	for rc.size > rc.MaxBytes && rc.lru.Len() > 0 {
+		rc.remove(rc.lru.Back().Value.(*cacheEntry))
+	}
+}
+
+// remove forgets an entry and deletes its files
+func (rc *RenderCache) remove(entry *cacheEntry) {
+	rc.forget(entry)
+	for _, name := range entry.files {
+		if err := os.Remove(filepath.Join(rc.Dir, name)); err != nil && !os.IsNotExist(err) {
+			log.Printf("[ERROR] RenderCache.remove: %v", err)
+		}
+	}
+}
+
+// forget drops an entry from the index, leaving its files alone
+func (rc *RenderCache) forget(entry *cacheEntry) {
+	rc.lru.Remove(entry.elem)
+	if entry.key != "" && rc.byKey[entry.key] == entry {
+		delete(rc.byKey, entry.key)
+	}
+	for _, name := range entry.files {
+		if rc.byFile[name] == entry {
+			delete(rc.byFile, name)
+		}
+	}
+	rc.size -= entry.size
+}
+
+// etag returns the ETag of a file in Dir and whether it can be cached
+// forever. Renders are named after their key, so the key is a strong ETag;
+// other files fall back to their size and modification time.
+func (rc *RenderCache) etag(name string, info os.FileInfo) (string, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if entry, ok := rc.byFile[name]; ok {
+		rc.lru.MoveToFront(entry.elem)
+		if entry.key != "" {
+			return `"` + entry.key + `"`, true
+		}
+	}
+	return fmt.Sprintf(`W/"%x-%x"`, info.Size(), info.ModTime().UnixNano()), false
+}
+
+// serveStatic serves the files in Dir with ETag and If-None-Match support
+func (rc *RenderCache) serveStatic(c *gin.Context) {
+	name := strings.TrimPrefix(c.Param("filepath"), "/")
+	if checkName(name) != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	path := filepath.Join(rc.Dir, name)
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	etag, immutable := rc.etag(name, info)
+	c.Header("ETag", etag)
+	if immutable {
+		c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		c.Header("Cache-Control", "no-cache")
+	}
+	// http.ServeFile answers If-None-Match with 304 using the ETag header
+	c.File(path)
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Ink modes of visualization layers. COPY, the default, draws normally.
+const (
+	inkCopy     = "COPY"
+	inkAdd      = "ADD"
+	inkSubtract = "SUBTRACT"
+)
+
+// compositeLayer holds the properties of a visualization layer. They are
+// pointers so that a direction override only replaces what it sets, and
+// missing values keep the client defaults.
+type compositeLayer struct {
+	Z     *float64 `json:"z"`
+	Alpha *int     `json:"alpha"`
+	Ink   *string  `json:"ink"`
+	X     *float64 `json:"x"`
+	Y     *float64 `json:"y"`
+}
+
+type compositeFrame struct {
+	ID int     `json:"id"`
+	X  float64 `json:"x"`
+	Y  float64 `json:"y"`
+}
+
+// Limits of what the compositor allocates. Unsaved JSON can claim any frame
+// size or offset, and every frame of a render gets its own canvas.
+const (
+	maxCompositePixels      = 2048 * 2048 // one canvas
+	maxCompositeTotalPixels = 1 << 26     // all the canvases of a render
+)
+
+type compositeAnimationLayer struct {
+	LoopCount      int `json:"loopCount"`
+	FrameRepeat    int `json:"frameRepeat"`
+	FrameSequences map[string]struct {
+		Frames map[string]compositeFrame `json:"frames"`
+	} `json:"frameSequences"`
+}
+
+type compositeVisualization struct {
+	Size       int                       `json:"size"`
+	LayerCount int                       `json:"layerCount"`
+	Layers     map[string]compositeLayer `json:"layers"`
+	Directions map[string]struct {
+		Layers map[string]compositeLayer `json:"layers"`
+	} `json:"directions"`
+	Colors     map[string]NitroColor `json:"colors"`
+	Animations map[string]struct {
+		Layers map[string]compositeAnimationLayer `json:"layers"`
+	} `json:"animations"`
+}
+
+// compositeDoc is the part of a furni JSON the compositor reads
+type compositeDoc struct {
+	Name           string                   `json:"name"`
+	Assets         map[string]NitroAsset    `json:"assets"`
+	Visualizations []compositeVisualization `json:"visualizations"`
+	Spritesheet    NitroSpritesheet         `json:"spritesheet"`
+}
+
+// Compositor renders a furni from its JSON and spritesheet directly,
+// without nx, so edits can be previewed before they are saved
+type Compositor struct {
+	doc     compositeDoc
+	sheet   image.Image
+	sprites map[string]*image.NRGBA
+}
+
+// compositeSpec is what to render: like imager.Furni, for the compositor
+type compositeSpec struct {
+	Size, Direction, State, Color int
+	Shadow                        bool
+}
+
+// compositeSprite is one asset placed for a frame
+type compositeSprite struct {
+	img   *image.NRGBA
+	at    image.Point // top-left corner, relative to the registration point
+	alpha int
+	ink   string
+	tint  color.NRGBA
+	z     float64
+	layer int
+}
+
+// NewCompositor reads the JSON and spritesheet of an in-memory library
+func NewCompositor(lib *NitroLibrary) (*Compositor, error) {
+	data := lib.OriginalJSON
+	if data == nil {
+		var err error
+		if data, err = json.Marshal(lib.Furni); err != nil {
+			return nil, fmt.Errorf("error serializing JSON: %v", err)
+		}
+	}
+	c := &Compositor{sprites: make(map[string]*image.NRGBA)}
+	if err := json.Unmarshal(data, &c.doc); err != nil {
+		return nil, fmt.Errorf("%w: error parsing JSON: %v", ErrInvalidRender, err)
+	}
+	for _, name := range sortedKeys(c.doc.Spritesheet.Frames) {
+		if err := checkSpriteFrame(c.doc.Spritesheet.Frames[name]); err != nil {
+			return nil, fmt.Errorf("%w: frame %s: %v", ErrInvalidRender, name, err)
+		}
+	}
+	sheet, err := getOriginalPNG(lib)
+	if err != nil {
+		return nil, err
+	}
+	c.sheet = sheet
+	return c, nil
+}
+
+// visualization returns the visualization of a size, or nil
+func (c *Compositor) visualization(size int) *compositeVisualization {
+	for i := range c.doc.Visualizations {
+		if c.doc.Visualizations[i].Size == size {
+			return &c.doc.Visualizations[i]
+		}
+	}
+	return nil
+}
+
+// Sizes lists the sizes the furni has visualizations for, largest first
+func (c *Compositor) Sizes() []int {
+	var sizes []int
+	for _, vis := range c.doc.Visualizations {
+		sizes = append(sizes, vis.Size)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(sizes)))
+	return sizes
+}
+
+// Direction returns the direction rendered at size: the one requested if
+// the visualization has it, else the first of 2, 4, 6 and 0, like nx
+func (c *Compositor) Direction(size, requested int) (int, error) {
+	vis := c.visualization(size)
+	if vis == nil {
+		return 0, fmt.Errorf("%w: no visualization for size: %d", ErrInvalidRender, size)
+	}
+	if _, ok := vis.Directions[strconv.Itoa(requested)]; ok || len(vis.Directions) == 0 {
+		return requested, nil
+	}
+	for i := range 4 {
+		d := (2 + i*2) % 8
+		if _, ok := vis.Directions[strconv.Itoa(d)]; ok {
+			return d, nil
+		}
+	}
+	return requested, nil
+}
+
+// PlayLength is the number of frames the animation of a state takes to
+// play once, 1 for static states
+func (c *Compositor) PlayLength(size, state int) int {
+	length := 1
+	vis := c.visualization(size)
+	if vis == nil {
+		return length
+	}
+	for _, layer := range vis.Animations[strconv.Itoa(state)].Layers {
+		frames, _ := layer.sequence()
+		length = max(length, len(frames)*max(1, layer.FrameRepeat)*max(1, layer.LoopCount))
+	}
+	return length
+}
+
+// sequence returns the frames of the first frame sequence of a layer, in order
+func (l compositeAnimationLayer) sequence() ([]compositeFrame, bool) {
+	keys := make([]string, 0, len(l.FrameSequences))
+	for key := range l.FrameSequences {
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, false
+	}
+	sort.Slice(keys, func(i, j int) bool { return numericLess(keys[i], keys[j]) })
+	seq := l.FrameSequences[keys[0]].Frames
+
+	frameKeys := make([]string, 0, len(seq))
+	for key := range seq {
+		frameKeys = append(frameKeys, key)
+	}
+	sort.Slice(frameKeys, func(i, j int) bool { return numericLess(frameKeys[i], frameKeys[j]) })
+	frames := make([]compositeFrame, len(frameKeys))
+	for i, key := range frameKeys {
+		frames[i] = seq[key]
+	}
+	return frames, len(frames) > 0
+}
+
+// frameAt returns the frame a layer shows at tick. Layers with a loopCount
+// stop on their last frame once they played that many times.
+func (l compositeAnimationLayer) frameAt(tick int) (compositeFrame, bool) {
+	frames, ok := l.sequence()
+	if !ok {
+		return compositeFrame{}, false
+	}
+	step := tick / max(1, l.FrameRepeat)
+	if l.LoopCount > 0 && step >= l.LoopCount*len(frames) {
+		return frames[len(frames)-1], true
+	}
+	return frames[step%len(frames)], true
+}
+
+// numericLess orders JSON object keys that hold numbers by value
+func numericLess(a, b string) bool {
+	x, errA := strconv.Atoi(a)
+	y, errB := strconv.Atoi(b)
+	if errA != nil || errB != nil {
+		return a < b
+	}
+	return x < y
+}
+
+// sprite returns the image of an asset, flipped as the asset asks, with
+// the asset itself
+func (c *Compositor) sprite(name string) (*image.NRGBA, NitroAsset, bool) {
+	asset, ok := c.doc.Assets[name]
+	if !ok {
+		return nil, asset, false
+	}
+	source := name
+	if asset.Source != "" {
+		source = asset.Source
+	}
+	cacheKey := fmt.Sprintf("%s/%t/%t", source, asset.FlipH, asset.FlipV)
+	if img, ok := c.sprites[cacheKey]; ok {
+		return img, asset, img != nil
+	}
+
+	frame, ok := c.doc.Spritesheet.Frames[source]
+	var img *image.NRGBA
+	if ok {
+		img = spritesheetFrame(c.sheet, frame)
+		if asset.FlipH {
+			img = flipImage(img, true)
+		}
+		if asset.FlipV {
+			img = flipImage(img, false)
+		}
+	}
+	c.sprites[cacheKey] = img
+	return img, asset, img != nil
+}
+
+// checkSpriteFrame makes sure cutting a frame out with spritesheetFrame
+// allocates no more than a spritesheet could
+func checkSpriteFrame(frame NitroSpriteFrame) error {
+	for _, size := range []NitroSize{frame.Frame, frame.SourceSize} {
+		if size.W < 0 || size.H < 0 {
+			return fmt.Errorf("negative size %dx%d", size.W, size.H)
+		}
+		if int64(size.W)*int64(size.H) > maxSpritesheetPixels {
+			return fmt.Errorf("size %dx%d is too large", size.W, size.H)
+		}
+	}
+	return nil
+}
+
+// spritesheetFrame cuts a frame out of a spritesheet, undoing the rotation
+// and trimming of the packer. Frames must pass checkSpriteFrame.
+func spritesheetFrame(sheet image.Image, frame NitroSpriteFrame) *image.NRGBA {
+	f := frame.Frame
+	var img *image.NRGBA
+	if frame.Rotated {
+		// Rotated frames are stored turned 90° clockwise
+		region := image.Rect(f.X, f.Y, f.X+f.H, f.Y+f.W).Add(sheet.Bounds().Min)
+		img = image.NewNRGBA(image.Rect(0, 0, f.W, f.H))
+		for y := 0; y < f.H; y++ {
+			for x := 0; x < f.W; x++ {
+				img.Set(x, y, sheet.At(region.Min.X+f.H-1-y, region.Min.Y+x))
+			}
+		}
+	} else {
+		img = image.NewNRGBA(image.Rect(0, 0, f.W, f.H))
+		draw.Draw(img, img.Bounds(), sheet, sheet.Bounds().Min.Add(image.Pt(f.X, f.Y)), draw.Src)
+	}
+
+	if frame.Trimmed && frame.SourceSize.W > 0 && frame.SourceSize.H > 0 {
+		full := image.NewNRGBA(image.Rect(0, 0, frame.SourceSize.W, frame.SourceSize.H))
+		at := image.Pt(frame.SpriteSourceSize.X, frame.SpriteSourceSize.Y)
+		draw.Draw(full, img.Bounds().Add(at), img, image.Point{}, draw.Src)
+		img = full
+	}
+	return img
+}
+
+// flipImage mirrors an image horizontally or vertically
+func flipImage(src *image.NRGBA, horizontal bool) *image.NRGBA {
+	b := src.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			sx, sy := x, y
+			if horizontal {
+				sx = b.Dx() - 1 - x
+			} else {
+				sy = b.Dy() - 1 - y
+			}
+			dst.SetNRGBA(x, y, src.NRGBAAt(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return dst
+}
+
+// layerProps merges the properties of a layer with the overrides of a
+// direction
+func layerProps(vis *compositeVisualization, layer, direction int) compositeLayer {
+	id := strconv.Itoa(layer)
+	props := vis.Layers[id]
+	override := vis.Directions[strconv.Itoa(direction)].Layers[id]
+	if override.Z != nil {
+		props.Z = override.Z
+	}
+	if override.Alpha != nil {
+		props.Alpha = override.Alpha
+	}
+	if override.Ink != nil {
+		props.Ink = override.Ink
+	}
+	if override.X != nil {
+		props.X = override.X
+	}
+	if override.Y != nil {
+		props.Y = override.Y
+	}
+	return props
+}
+
+// Sprites returns the sprites of one frame, bottom first
+func (c *Compositor) Sprites(spec compositeSpec, tick int) ([]compositeSprite, error) {
+	vis := c.visualization(spec.Size)
+	if vis == nil {
+		return nil, fmt.Errorf("%w: no visualization for size: %d", ErrInvalidRender, spec.Size)
+	}
+	prefix := fmt.Sprintf("%s_%d", c.doc.Name, spec.Size)
+
+	var sprites []compositeSprite
+	if spec.Shadow {
+		if img, asset, ok := c.sprite(fmt.Sprintf("%s_sd_%d_0", prefix, spec.Direction)); ok {
+			sprites = append(sprites, compositeSprite{
+				img: img, at: assetOrigin(asset, img), alpha: 255, ink: inkCopy,
+				tint: color.NRGBA{255, 255, 255, 255}, z: -1e9, layer: -1,
+			})
+		}
+	}
+
+	animation := vis.Animations[strconv.Itoa(spec.State)]
+	colors := c.colorLayers(vis, spec.Color)
+	for layer := 0; layer < vis.LayerCount && layer < 26; layer++ {
+		frame := compositeFrame{}
+		if animLayer, ok := animation.Layers[strconv.Itoa(layer)]; ok {
+			if f, ok := animLayer.frameAt(tick); ok {
+				frame = f
+			}
+		}
+		name := fmt.Sprintf("%s_%c_%d_%d", prefix, 'a'+layer, spec.Direction, frame.ID)
+		img, asset, ok := c.sprite(name)
+		if !ok {
+			continue
+		}
+
+		props := layerProps(vis, layer, spec.Direction)
+		sprite := compositeSprite{
+			img:   img,
+			at:    assetOrigin(asset, img).Add(image.Pt(int(math.Round(frame.X)), int(math.Round(frame.Y)))),
+			alpha: 255,
+			ink:   inkCopy,
+			tint:  color.NRGBA{255, 255, 255, 255},
+			layer: layer,
+		}
+		if props.Z != nil {
+			sprite.z = *props.Z
+		}
+		if props.Alpha != nil {
+			sprite.alpha = min(max(*props.Alpha, 0), 255)
+		}
+		if props.Ink != nil && *props.Ink != "" {
+			sprite.ink = strings.ToUpper(*props.Ink)
+		}
+		if props.X != nil {
+			sprite.at.X += int(math.Round(*props.X))
+		}
+		if props.Y != nil {
+			sprite.at.Y += int(math.Round(*props.Y))
+		}
+		if tint, ok := colors[layer]; ok {
+			sprite.tint = tint
+		}
+		sprites = append(sprites, sprite)
+	}
+
+	sort.SliceStable(sprites, func(i, j int) bool {
+		if sprites[i].z != sprites[j].z {
+			return sprites[i].z < sprites[j].z
+		}
+		return sprites[i].layer < sprites[j].layer
+	})
+	return sprites, nil
+}
+
+// colorLayers returns the tint of each layer colored by a color ID
+func (c *Compositor) colorLayers(vis *compositeVisualization, colorID int) map[int]color.NRGBA {
+	tints := make(map[int]color.NRGBA)
+	for key, layer := range vis.Colors[strconv.Itoa(colorID)].Layers {
+		id, err := strconv.Atoi(key)
+		if err != nil {
+			continue
+		}
+		tint, err := parseHexColor("#" + strings.TrimPrefix(layer.Color, "#"))
+		if err != nil {
+			continue
+		}
+		tints[id] = color.NRGBA{tint.R, tint.G, tint.B, 255}
+	}
+	return tints
+}
+
+// assetOrigin is where the top-left corner of an asset image goes, relative
+// to the registration point at x, y of the asset. Flipped assets keep x, y
+// from the image they were flipped from.
+func assetOrigin(asset NitroAsset, img *image.NRGBA) image.Point {
+	at := image.Pt(-int(asset.X), -int(asset.Y))
+	if asset.FlipH {
+		at.X = int(asset.X) - img.Bounds().Dx()
+	}
+	if asset.FlipV {
+		at.Y = int(asset.Y) - img.Bounds().Dy()
+	}
+	return at
+}
+
+// Render composes count frames from tick start on canvases of one size
+func (c *Compositor) Render(spec compositeSpec, start, count int) ([]*image.NRGBA, error) {
+	ticks := make([][]compositeSprite, count)
+	var bounds image.Rectangle
+	for i := range ticks {
+		sprites, err := c.Sprites(spec, start+i)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range sprites {
+			bounds = bounds.Union(s.img.Bounds().Add(s.at))
+		}
+		ticks[i] = sprites
+	}
+	if bounds.Empty() {
+		return nil, fmt.Errorf("no layers in animation for direction %d, state %d", spec.Direction, spec.State)
+	}
+	if err := checkCanvas(bounds, count); err != nil {
+		return nil, err
+	}
+
+	frames := make([]*image.NRGBA, count)
+	for i, sprites := range ticks {
+		frame := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		for _, s := range sprites {
+			drawInk(frame, s, s.at.Sub(bounds.Min))
+		}
+		frames[i] = frame
+	}
+	return frames, nil
+}
+
+// checkCanvas rejects renders of count frames on canvases of bounds that
+// would take more than the compositor limits
+func checkCanvas(bounds image.Rectangle, count int) error {
+	pixels := int64(bounds.Dx()) * int64(bounds.Dy())
+	if bounds.Dx() < 0 || bounds.Dy() < 0 || pixels > maxCompositePixels {
+		return fmt.Errorf("%w: a %dx%d canvas is too large", ErrInvalidRender, bounds.Dx(), bounds.Dy())
+	}
+	if pixels*int64(count) > maxCompositeTotalPixels {
+		return fmt.Errorf("%w: %d frames of %dx%d are too large", ErrInvalidRender, count, bounds.Dx(), bounds.Dy())
+	}
+	return nil
+}
+
+// drawInk draws a sprite at a point of dst with its ink, alpha and tint.
+// ADD brightens what is below and SUBTRACT darkens it; COPY and unknown inks
+// draw normally.
+func drawInk(dst *image.NRGBA, s compositeSprite, at image.Point) {
+	b := s.img.Bounds()
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			dx, dy := at.X+x, at.Y+y
+			if !(image.Point{dx, dy}.In(dst.Bounds())) {
+				continue
+			}
+			src := s.img.NRGBAAt(b.Min.X+x, b.Min.Y+y)
+			sa := int(src.A) * s.alpha / 255
+			if sa == 0 {
+				continue
+			}
+			sr := int(src.R) * int(s.tint.R) / 255
+			sg := int(src.G) * int(s.tint.G) / 255
+			sb := int(src.B) * int(s.tint.B) / 255
+
+			i := dst.PixOffset(dx, dy)
+			d := dst.Pix[i : i+4 : i+4]
+			da := int(d[3])
+			switch s.ink {
+			case inkAdd:
+				// Premultiplied sum, so glows on transparent pixels keep their color
+				a := min(255, sa+da)
+				d[0] = uint8(min(255, (int(d[0])*da+sr*sa)/a))
+				d[1] = uint8(min(255, (int(d[1])*da+sg*sa)/a))
+				d[2] = uint8(min(255, (int(d[2])*da+sb*sa)/a))
+				d[3] = uint8(a)
+			case inkSubtract:
+				if da == 0 {
+					continue
+				}
+				d[0] = uint8(max(0, (int(d[0])*da-sr*sa)/da))
+				d[1] = uint8(max(0, (int(d[1])*da-sg*sa)/da))
+				d[2] = uint8(max(0, (int(d[2])*da-sb*sa)/da))
+			default:
+				a := sa + da*(255-sa)/255
+				d[0] = uint8((sr*sa + int(d[0])*da*(255-sa)/255) / a)
+				d[1] = uint8((sg*sa + int(d[1])*da*(255-sa)/255) / a)
+				d[2] = uint8((sb*sa + int(d[2])*da*(255-sa)/255) / a)
+				d[3] = uint8(a)
+			}
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/kettek/apng"
+	"xabbo.io/nx/imager"
+)
+
+// Output formats for RenderRequest.Format
+const (
+	formatGIF   = "gif"
+	formatPNG   = "png"   // first frame only, full alpha
+	formatAPNG  = "apng"  // animated PNG, full alpha
+	formatStrip = "strip" // frames side by side, plus JSON timing
+)
+
+// animationFPS is the rate furni animations play at by default
+const animationFPS = 24
+
+// RenderOutput describes the files a render wrote to ../static
+type RenderOutput struct {
+	Filename   string
+	Format     string
+	Direction  int
+	State      int
+	Color      int
+	Warnings   []string
+	TimingFile string
+	Timing     *StripTiming
+	FrameCount int
+}
+
+// StripTiming tells a client how to play a sprite strip
+type StripTiming struct {
+	Image       string       `json:"image"`
+	FrameWidth  int          `json:"frame_width"`
+	FrameHeight int          `json:"frame_height"`
+	FrameCount  int          `json:"frame_count"`
+	FPS         int          `json:"fps"`
+	LoopCount   int          `json:"loop_count"` // 0 plays forever
+	Frames      []StripFrame `json:"frames"`
+}
+
+// StripFrame locates one frame in a sprite strip
+type StripFrame struct {
+	X        int `json:"x"`
+	Y        int `json:"y"`
+	W        int `json:"w"`
+	H        int `json:"h"`
+	Duration int `json:"duration_ms"`
+}
+
+// renderFormat checks a requested output format, defaulting to GIF
+func renderFormat(format string) (string, error) {
+	switch strings.ToLower(format) {
+	case "", formatGIF:
+		return formatGIF, nil
+	case formatPNG, formatAPNG, formatStrip:
+		return strings.ToLower(format), nil
+	}
+	return "", fmt.Errorf("%w: unknown format %q, use gif, png, apng or strip", ErrInvalidRender, format)
+}
+
+// renderFrames renders frameCount frames of sequence seq from frame start
+// with the nx PNG encoder. Frames are returned on canvases of the same size,
+// top-left aligned, so they can be played or laid out as they are.
+func renderFrames(anim imager.Animation, seq, start, frameCount int) ([]*image.NRGBA, error) {
+	encoder := imager.NewEncoderPNG()
+	decoded := make([]image.Image, 0, frameCount)
+	width, height := 1, 1
+	for frame := start; frame < start+frameCount; frame++ {
+		var buf bytes.Buffer
+		if err := encoder.EncodeFrame(&buf, anim, seq, frame); err != nil {
+			return nil, fmt.Errorf("error rendering frame %d: %v", frame, err)
+		}
+		img, err := png.Decode(&buf)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding frame %d: %v", frame, err)
+		}
+		width = max(width, img.Bounds().Dx())
+		height = max(height, img.Bounds().Dy())
+		decoded = append(decoded, img)
+	}
+
+	frames := make([]*image.NRGBA, len(decoded))
+	for i, img := range decoded {
+		canvas := image.NewNRGBA(image.Rect(0, 0, width, height))
+		draw.Draw(canvas, img.Bounds().Sub(img.Bounds().Min), img, img.Bounds().Min, draw.Src)
+		frames[i] = canvas
+	}
+	return frames, nil
+}
+
+// frameDurationMs is how long each frame shows at animationFPS
+func frameDurationMs() int {
+	return (1000 + animationFPS/2) / animationFPS
+}
+
+// encodeGIF writes frames as a GIF played with timing. Pixels more than
+// half transparent become transparent; frames with more colors than a GIF
+// palette holds are dithered to the web-safe palette.
+func encodeGIF(w io.Writer, frames []*image.NRGBA, timing frameTiming) error {
+	transparent := color.RGBA{}
+	pal := color.Palette{transparent}
+	exact := make(map[color.RGBA]uint8)
+	opaque := make([]*image.NRGBA, len(frames))
+	for i, frame := range frames {
+		opaque[i] = image.NewNRGBA(frame.Bounds())
+		for p := 0; p < len(frame.Pix); p += 4 {
+			px := frame.Pix[p : p+4]
+			if px[3] < 128 {
+				continue
+			}
+			copy(opaque[i].Pix[p:], []byte{px[0], px[1], px[2], 255})
+			c := color.RGBA{px[0], px[1], px[2], 255}
+			if _, ok := exact[c]; !ok && exact != nil {
+				if len(pal) == 256 {
+					exact = nil
+					continue
+				}
+				exact[c] = uint8(len(pal))
+				pal = append(pal, c)
+			}
+		}
+	}
+	if exact == nil {
+		pal = append(color.Palette{transparent}, palette.WebSafe...)
+	}
+
+	// GIF delays are in hundredths of a second and LoopCount counts the
+	// repeats after the first play, -1 meaning none
+	delay := max(1, (timing.delayMs+5)/10)
+	out := &gif.GIF{}
+	switch timing.loops {
+	case 0:
+		out.LoopCount = 0
+	case 1:
+		out.LoopCount = -1
+	default:
+		out.LoopCount = timing.loops - 1
+	}
+	for _, frame := range opaque {
+		img := image.NewPaletted(frame.Bounds(), pal)
+		if exact != nil {
+			for p, i := 0, 0; p < len(frame.Pix); p, i = p+4, i+1 {
+				if frame.Pix[p+3] != 0 {
+					img.Pix[i] = exact[color.RGBA{frame.Pix[p], frame.Pix[p+1], frame.Pix[p+2], 255}]
+				}
+			}
+		} else {
+			draw.FloydSteinberg.Draw(img, img.Bounds(), frame, frame.Bounds().Min)
+		}
+		out.Image = append(out.Image, img)
+		out.Delay = append(out.Delay, delay)
+		out.Disposal = append(out.Disposal, gif.DisposalBackground)
+	}
+	return gif.EncodeAll(w, out)
+}
+
+// encodeAPNG writes frames as an animated PNG played with timing
+func encodeAPNG(w io.Writer, frames []*image.NRGBA, timing frameTiming) error {
+	a := apng.APNG{Frames: make([]apng.Frame, len(frames)), LoopCount: uint(timing.loops)}
+	for i, frame := range frames {
+		a.Frames[i] = apng.Frame{
+			Image:            frame,
+			DelayNumerator:   uint16(timing.delayMs),
+			DelayDenominator: 1000,
+		}
+	}
+	return apng.Encode(w, a)
+}
+
+// buildStrip lays frames out left to right and describes where each one is
+func buildStrip(frames []*image.NRGBA, imageName string, timing frameTiming) (*image.NRGBA, *StripTiming) {
+	frameW, frameH := frames[0].Bounds().Dx(), frames[0].Bounds().Dy()
+	strip := image.NewNRGBA(image.Rect(0, 0, frameW*len(frames), frameH))
+	stripTiming := &StripTiming{
+		Image:       imageName,
+		FrameWidth:  frameW,
+		FrameHeight: frameH,
+		FrameCount:  len(frames),
+		FPS:         timing.fps(),
+		LoopCount:   timing.loops,
+		Frames:      make([]StripFrame, len(frames)),
+	}
+	for i, frame := range frames {
+		at := image.Pt(i*frameW, 0)
+		draw.Draw(strip, frame.Bounds().Add(at), frame, image.Point{}, draw.Src)
+		stripTiming.Frames[i] = StripFrame{X: at.X, Y: at.Y, W: frameW, H: frameH, Duration: timing.delayMs}
+	}
+	return strip, stripTiming
+}
+
+// styledFrames renders frameCount frames of anim from frame start,
+// presented in style
+func styledFrames(anim imager.Animation, start, frameCount int, style renderStyle) ([]*image.NRGBA, error) {
+	frames, err := renderFrames(anim, 0, start, frameCount)
+	if err != nil {
+		return nil, err
+	}
+	return style.apply(frames), nil
+}
+
+// writeRenderOutput encodes the frames of anim picked by timing in format
+// under ../static/base plus the format's extension, filling in the output's
+// file names
+func writeRenderOutput(output *RenderOutput, anim imager.Animation, base string, style renderStyle, timing frameTiming) error {
+	if output.Format == formatGIF && style.plain() && timing.plain() {
+		output.Filename = base + ".gif"
+		output.FrameCount = timing.count
+		// Render animation to GIF using nx encoder
+		encoder := imager.NewEncoderGIF()
+		return writeStatic(output.Filename, func(w io.Writer) error {
+			return encoder.EncodeAnimation(w, anim, 0, timing.count)
+		})
+	}
+
+	count := timing.count
+	if output.Format == formatPNG {
+		count = 1
+	}
+	frames, err := styledFrames(anim, timing.start, count, style)
+	if err != nil {
+		return err
+	}
+	return writeRenderFrames(output, frames, base, timing)
+}
+
+// writeRenderFrames encodes rendered frames in format under
+// ../static/base plus the format's extension, filling in the output's file
+// names. PNG renders keep the first frame only.
+func writeRenderFrames(output *RenderOutput, frames []*image.NRGBA, base string, timing frameTiming) error {
+	output.FrameCount = len(frames)
+	switch output.Format {
+	case formatGIF:
+		output.Filename = base + ".gif"
+		return writeStatic(output.Filename, func(w io.Writer) error {
+			return encodeGIF(w, frames, timing)
+		})
+
+	case formatPNG:
+		output.Filename = base + ".png"
+		output.FrameCount = 1
+		return writeStatic(output.Filename, func(w io.Writer) error {
+			return png.Encode(w, frames[0])
+		})
+
+	case formatAPNG:
+		output.Filename = base + "_apng.png"
+		return writeStatic(output.Filename, func(w io.Writer) error {
+			return encodeAPNG(w, frames, timing)
+		})
+
+	case formatStrip:
+		output.Filename = base + "_strip.png"
+		output.TimingFile = base + "_strip.json"
+		strip, stripTiming := buildStrip(frames, output.Filename, timing)
+		output.Timing = stripTiming
+		if err := writeStatic(output.Filename, func(w io.Writer) error {
+			return png.Encode(w, strip)
+		}); err != nil {
+			return err
+		}
+		data, err := json.MarshalIndent(stripTiming, "", "  ")
+		if err != nil {
+			return err
+		}
+		return writeStatic(output.TimingFile, func(w io.Writer) error {
+			_, err := w.Write(data)
+			return err
+		})
+	}
+	return fmt.Errorf("%w: unknown format %q", ErrInvalidRender, output.Format)
+}
+
+// writeStatic atomically replaces a file in ../static, since requests that
+// fall back to the same direction can render it at the same time
+func writeStatic(name string, write func(w io.Writer) error) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join("../static", name), 0, write)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Repairs made by FixLibrary
+const (
+	fixLayerCount  = "layer_count"
+	fixDirection   = "add_direction"
+	fixOrphanAsset = "remove_orphan_asset"
+	fixDuplicate   = "dedupe_frame"
+	fixOrphanFrame = "remove_orphan_frame"
+)
+
+// FixChange is one repair made by FixLibrary, at a JSON pointer of the furni
+type FixChange struct {
+	Fix     string `json:"fix"`
+	Pointer string `json:"pointer"`
+	Message string `json:"message"`
+}
+
+type fixer struct {
+	lib     *NitroLibrary
+	furni   *NitroFurni
+	changes []FixChange
+}
+
+func (f *fixer) change(fix, pointer, format string, args ...interface{}) {
+	f.changes = append(f.changes, FixChange{Fix: fix, Pointer: pointer, Message: fmt.Sprintf(format, args...)})
+}
+
+// FixLibrary makes the repairs that can't change how a furni looks:
+// visualizations get the logic directions they miss, orphan assets go, layer
+// counts drop to the last layer with assets, assets of identical frames share
+// one frame and frames no asset uses go. The PNG isn't repacked.
+func FixLibrary(lib *NitroLibrary) []FixChange {
+	f := &fixer{lib: lib, furni: lib.Furni, changes: []FixChange{}}
+	f.directions()
+	f.orphanAssets()
+	f.layerCounts()
+	f.duplicateFrames()
+	f.orphanFrames()
+	return f.changes
+}
+
+// layerCounts lowers the layerCount of each visualization to the last layer
+// it has assets or layer, direction, color or animation entries for. It
+// never raises it: assets beyond layerCount aren't drawn, and drawing them
+// would change the furni.
+func (f *fixer) layerCounts() {
+	for i := range f.furni.Visualizations {
+		vis := &f.furni.Visualizations[i]
+		count := 0
+		for name := range f.furni.Assets {
+			size, layer, ok := f.furni.layerAsset(name)
+			if ok && size == vis.Size && len(layer) == 1 && layer[0] >= 'a' && layer[0] <= 'z' {
+				count = max(count, int(layer[0]-'a')+1)
+			}
+		}
+		if count == 0 {
+			continue
+		}
+		count = layerEntries(count, vis.Layers)
+		for _, direction := range vis.Directions {
+			count = layerEntries(count, direction.Layers)
+		}
+		for _, color := range vis.Colors {
+			count = layerEntries(count, color.Layers)
+		}
+		for _, animation := range vis.Animations {
+			count = layerEntries(count, animation.Layers)
+		}
+		if count < vis.LayerCount {
+			f.change(fixLayerCount, fmt.Sprintf("/visualizations/%d/layerCount", i),
+				"layerCount of size %d changed from %d to %d, the last layer in use", vis.Size, vis.LayerCount, count)
+			vis.LayerCount = count
+		}
+	}
+}
+
+// layerEntries raises count past the layer indexes of layers
+func layerEntries[V any](count int, layers map[string]V) int {
+	for key := range layers {
+		if id, err := strconv.Atoi(key); err == nil {
+			count = max(count, id+1)
+		}
+	}
+	return count
+}
+
+// directions adds the logic directions a visualization doesn't list. Icons,
+// the size 1 visualization, have no directions.
+func (f *fixer) directions() {
+	for i := range f.furni.Visualizations {
+		vis := &f.furni.Visualizations[i]
+		if vis.Size == 1 {
+			continue
+		}
+		for _, d := range f.furni.Logic.Model.Directions {
+			key := strconv.Itoa(d)
+			if _, ok := vis.Directions[key]; ok {
+				continue
+			}
+			if vis.Directions == nil {
+				vis.Directions = make(map[string]NitroDirection)
+			}
+			vis.Directions[key] = NitroDirection{Id: d}
+			f.change(fixDirection, fmt.Sprintf("/visualizations/%d/directions/%d", i, d),
+				"added direction %d of logic.model.directions to size %d", d, vis.Size)
+		}
+	}
+}
+
+// orphanAssets removes the layer assets no visualization shows
+func (f *fixer) orphanAssets() {
+	used := f.furni.usedAssets()
+	for _, name := range sortedKeys(f.furni.Assets) {
+		if _, _, ok := f.furni.layerAsset(name); ok && !used[name] {
+			delete(f.furni.Assets, name)
+			f.change(fixOrphanAsset, "/assets/"+pointerEscaper.Replace(name),
+				"removed asset %s, no visualization shows it", name)
+		}
+	}
+}
+
+// duplicateFrames points the assets of frames with identical pixels at one
+// of them and removes the others
+func (f *fixer) duplicateFrames() {
+	sheet, err := getOriginalPNG(f.lib)
+	if err != nil {
+		log.Printf("[DEBUG] FixLibrary: not deduplicating frames: %v", err)
+		return
+	}
+	// Frames no asset uses are left to orphanFrames
+	frames := f.furni.Spritesheet.Frames
+	referenced := f.furni.referencedFrames()
+	var names []string
+	for _, name := range sortedKeys(frames) {
+		if referenced[name] {
+			names = append(names, name)
+		}
+	}
+	// Prefer keeping frames named after an asset
+	sort.SliceStable(names, func(i, j int) bool {
+		_, a := f.furni.Assets[names[i]]
+		_, b := f.furni.Assets[names[j]]
+		return a && !b
+	})
+	first := make(map[[32]byte]string)
+	duplicateOf := make(map[string]string)
+	for _, name := range names {
+		if checkSpriteFrame(frames[name]) != nil {
+			continue
+		}
+		img := spritesheetFrame(sheet, frames[name])
+		h := sha256.New()
+		fmt.Fprintf(h, "%v", img.Bounds())
+		h.Write(img.Pix)
+		var sum [32]byte
+		copy(sum[:], h.Sum(nil))
+		if kept, ok := first[sum]; ok {
+			duplicateOf[name] = kept
+		} else {
+			first[sum] = name
+		}
+	}
+	if len(duplicateOf) == 0 {
+		return
+	}
+
+	for _, name := range sortedKeys(f.furni.Assets) {
+		asset := f.furni.Assets[name]
+		source := name
+		if asset.Source != "" {
+			source = asset.Source
+		}
+		frame, ok := f.furni.spriteFrame(source)
+		if !ok {
+			continue
+		}
+		if kept, ok := duplicateOf[frame]; ok {
+			asset.Source = kept
+			f.furni.Assets[name] = asset
+			f.change(fixDuplicate, "/assets/"+pointerEscaper.Replace(name)+"/source",
+				"asset %s now uses frame %s, identical to %s", name, kept, frame)
+		}
+	}
+	for _, name := range sortedKeys(duplicateOf) {
+		delete(frames, name)
+		f.change(fixDuplicate, "/spritesheet/frames/"+pointerEscaper.Replace(name),
+			"removed frame %s, identical to %s", name, duplicateOf[name])
+	}
+}
+
+// orphanFrames removes the spritesheet frames no asset uses
+func (f *fixer) orphanFrames() {
+	referenced := f.furni.referencedFrames()
+	for _, name := range sortedKeys(f.furni.Spritesheet.Frames) {
+		if !referenced[name] {
+			delete(f.furni.Spritesheet.Frames, name)
+			f.change(fixOrphanFrame, "/spritesheet/frames/"+pointerEscaper.Replace(name),
+				"removed frame %s, no asset uses it", name)
+		}
+	}
+}
+
+// fixFurni repairs a stored furni, or with dry_run=true only reports the
+// changes it would make
+func fixFurni(c *gin.Context) {
+	ws := requestWorkspace(c)
+	if ws == nil {
+		return
+	}
+
+	filename := c.Param("filename")
+	if filepath.Ext(filename) != ".nitro" {
+		filename = filename + ".nitro"
+	}
+	dryRun := c.DefaultQuery("dry_run", "false") == "true"
+
+	unlock := ws.lockFiles(filename)
+	defer unlock()
+
+	lib, err := LoadNitroLibrary(ws.Store, filename)
+	if err != nil {
+		log.Printf("[ERROR] fixFurni: error loading nitro library: %v", err)
+		c.JSON(nitroErrorStatus(err), gin.H{"error": "Error loading .nitro file: " + err.Error()})
+		return
+	}
+	changes := FixLibrary(lib)
+	log.Printf("[DEBUG] fixFurni: %d changes to %s (dry run: %t)", len(changes), filename, dryRun)
+
+	response := gin.H{"dry_run": dryRun, "changes": changes, "lint": LintLibrary(lib)}
+	if !dryRun && len(changes) > 0 {
+		revision, err := saveWithRevision(lib, ws, filename, requestAuthor(c), "fix")
+		if err != nil {
+			log.Printf("[ERROR] fixFurni: error saving nitro file: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving .nitro file: " + err.Error()})
+			return
+		}
+		if revision != nil {
+			response["revision"] = revision.Number
+		}
+	}
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testFix parses a furni without a usable spritesheet, so frames aren't
+// deduplicated, and fixes it
+func testFix(t *testing.T, furniJSON string) (*NitroLibrary, []FixChange) {
+	t.Helper()
+	store := NewMemoryStore(0)
+	store.Put("chair.nitro", testArchive(t, "chair", furniJSON, testSheet(1, 1)))
+	lib, err := LoadNitroLibrary(store, "chair.nitro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lib, FixLibrary(lib)
+}
+
+func TestFixLayerCount(t *testing.T) {
+	tests := []struct {
+		name       string
+		layerCount int
+		vis        string
+		want       int
+	}{
+		{"unused layers", 4, `"layers": {}`, 1},
+		{"layer settings", 4, `"layers": {"2": {"z": 1}}`, 3},
+		{"direction settings", 4, `"directions": {"2": {"layers": {"1": {"alpha": 10}}}}`, 2},
+		{"colors", 4, `"colors": {"1": {"layers": {"3": {"color": "ff0000"}}}}`, 4},
+		{"animations", 4, `"animations": {"1": {"layers": {"2": {}}}}`, 3},
+		// An orphan asset beyond layerCount is removed, not drawn
+		{"never raised", 1, `"layers": {}`, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lib, changes := testFix(t, `{"name": "chair", "logic": {"model": {"directions": [2]}},
+				"assets": {"chair_64_a_2_0": {}, "chair_64_b_4_0": {}},
+				"visualizations": [{"size": 64, "layerCount": `+strconv.Itoa(tt.layerCount)+`, `+tt.vis+`}],
+				"spritesheet": {"frames": {}, "meta": {"image": "chair.png"}}}`)
+			if got := lib.Furni.Visualizations[0].LayerCount; got != tt.want {
+				t.Errorf("layerCount = %d, want %d (changes %+v)", got, tt.want, changes)
+			}
+			for _, issue := range LintLibrary(lib).Issues {
+				if strings.Contains(issue.Message, "beyond layerCount") {
+					t.Errorf("lint after fix: %+v", issue)
+				}
+			}
+		})
+	}
+}
+
+func TestFixDirections(t *testing.T) {
+	lib, changes := testFix(t, `{"name": "chair", "logic": {"model": {"directions": [2, 4]}},
+		"assets": {"chair_icon_a": {}},
+		"visualizations": [
+			{"size": 1, "layerCount": 1},
+			{"size": 64, "layerCount": 1, "directions": {"2": {}}}
+		],
+		"spritesheet": {"frames": {}, "meta": {"image": "chair.png"}}}`)
+	if icon := lib.Furni.Visualizations[0]; len(icon.Directions) != 0 {
+		t.Errorf("icon directions = %v", icon.Directions)
+	}
+	if _, ok := lib.Furni.Visualizations[1].Directions["4"]; !ok {
+		t.Errorf("direction 4 not added: %+v", changes)
+	}
+}
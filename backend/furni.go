@@ -0,0 +1,330 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Pagination defaults for GET /api/furni
+const (
+	defaultFurniLimit = 50
+	maxFurniLimit     = 500
+)
+
+// FurniListing is a stored furni as returned by GET /api/furni
+type FurniListing struct {
+	Filename string     `json:"filename"`
+	FileSize int64      `json:"file_size"`
+	ModTime  time.Time  `json:"mod_time"`
+	Info     *FurniInfo `json:"info,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// infoCache remembers the FurniInfo of stored files, so listing a workspace
+// only parses the files that changed since the last listing
+type infoCache struct {
+	mu      sync.Mutex
+	entries map[string]infoCacheEntry
+}
+
+type infoCacheEntry struct {
+	size    int64
+	modTime time.Time
+	info    *FurniInfo
+	err     error
+}
+
+func newInfoCache() *infoCache {
+	return &infoCache{entries: make(map[string]infoCacheEntry)}
+}
+
+// Info returns the FurniInfo of a stored file, parsing it again only when
+// its size or modification time changed
+func (c *infoCache) Info(store Store, entry StoreEntry) (*FurniInfo, error) {
+	c.mu.Lock()
+	cached, ok := c.entries[entry.Name]
+	c.mu.Unlock()
+	if ok && cached.size == entry.Size && cached.modTime.Equal(entry.ModTime) {
+		return cached.info, cached.err
+	}
+
+	info, err := processNitroFile(store, entry.Name)
+	c.mu.Lock()
+	c.entries[entry.Name] = infoCacheEntry{size: entry.Size, modTime: entry.ModTime, info: info, err: err}
+	c.mu.Unlock()
+	return info, err
+}
+
+// Prune forgets the files that are no longer stored
+func (c *infoCache) Prune(entries []StoreEntry) {
+	stored := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		stored[entry.Name] = true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name := range c.entries {
+		if !stored[name] {
+			delete(c.entries, name)
+		}
+	}
+}
+
+// furniLess returns the ordering for the sort query parameter of GET /api/furni
+func furniLess(key string) (func(a, b FurniListing) bool, bool) {
+	switch key {
+	case "", "name":
+		return func(a, b FurniListing) bool { return a.Filename < b.Filename }, true
+	case "size":
+		return func(a, b FurniListing) bool { return a.FileSize < b.FileSize }, true
+	case "mod_time":
+		return func(a, b FurniListing) bool { return a.ModTime.Before(b.ModTime) }, true
+	}
+	return nil, false
+}
+
+// queryInt parses an optional non-negative integer query parameter
+func queryInt(c *gin.Context, name string, def int) (int, bool) {
+	value := c.Query(name)
+	if value == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + name + ": " + value})
+		return 0, false
+	}
+	return n, true
+}
+
+// listFurni lists the furni stored in a workspace. Query parameters:
+//
+//	name               substring of the file or furni name (case insensitive)
+//	logicType          exact logic type, e.g. furniture_multistate
+//	visualizationType  exact visualization type, e.g. furniture_animated
+//	sort               name (default), size or mod_time; prefix with - to reverse
+//	offset, limit      pagination, limit defaults to 50 and is capped at 500
+func listFurni(c *gin.Context) {
+	ws := requestWorkspace(c)
+	if ws == nil {
+		return
+	}
+
+	sortKey := c.Query("sort")
+	descending := strings.HasPrefix(sortKey, "-")
+	less, ok := furniLess(strings.TrimPrefix(sortKey, "-"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sort must be name, size or mod_time"})
+		return
+	}
+	offset, ok := queryInt(c, "offset", 0)
+	if !ok {
+		return
+	}
+	limit, ok := queryInt(c, "limit", defaultFurniLimit)
+	if !ok {
+		return
+	}
+	if limit == 0 || limit > maxFurniLimit {
+		limit = maxFurniLimit
+	}
+
+	name := strings.ToLower(c.Query("name"))
+	logicType := c.Query("logicType")
+	visualizationType := c.Query("visualizationType")
+
+	entries, err := ws.Store.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error listing furni: " + err.Error()})
+		return
+	}
+	ws.infos.Prune(entries)
+
+	furni := []FurniListing{}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name, ".nitro") {
+			continue
+		}
+
+		listing := FurniListing{Filename: entry.Name, FileSize: entry.Size, ModTime: entry.ModTime}
+		info, err := ws.infos.Info(ws.Store, entry)
+		if err != nil {
+			// Broken files are still listed so they can be found and removed,
+			// but they can't match a type filter
+			if logicType != "" || visualizationType != "" {
+				continue
+			}
+			listing.Error = err.Error()
+		} else {
+			listing.Info = info
+		}
+
+		if name != "" && !strings.Contains(strings.ToLower(entry.Name), name) &&
+			(info == nil || !strings.Contains(strings.ToLower(info.Name), name)) {
+			continue
+		}
+		if logicType != "" && !strings.EqualFold(info.LogicType, logicType) {
+			continue
+		}
+		if visualizationType != "" && !strings.EqualFold(info.VisualizationType, visualizationType) {
+			continue
+		}
+		furni = append(furni, listing)
+	}
+
+	sort.SliceStable(furni, func(i, j int) bool {
+		if descending {
+			return less(furni[j], furni[i])
+		}
+		return less(furni[i], furni[j])
+	})
+
+	total := len(furni)
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"workspace": ws.ID,
+		"total":     total,
+		"offset":    offset,
+		"limit":     limit,
+		"furni":     furni[offset:end],
+	})
+}
+
+// furniFilename returns the stored name for the :filename route parameter
+func furniFilename(c *gin.Context) string {
+	filename := c.Param("filename")
+	if filepath.Ext(filename) != ".nitro" {
+		filename = filename + ".nitro"
+	}
+	return filename
+}
+
+// deleteFurni removes a stored furni with its backups, revisions and
+// cached renders
+func deleteFurni(c *gin.Context) {
+	ws := requestWorkspace(c)
+	if ws == nil {
+		return
+	}
+	filename := furniFilename(c)
+
+	log.Printf("[DEBUG] deleteFurni: deleting %s from workspace %s", filename, ws.ID)
+	unlock := ws.lockFiles(filename)
+	defer unlock()
+	if err := ws.Store.Delete(filename); err != nil {
+		log.Printf("[ERROR] deleteFurni: %v", err)
+		c.JSON(nitroErrorStatus(err), gin.H{"error": "Error deleting file: " + err.Error()})
+		return
+	}
+	if err := ws.History.Forget(filename); err != nil {
+		log.Printf("[ERROR] deleteFurni: error deleting revisions: %v", err)
+	}
+	renderCache.Invalidate(ws, filename)
+
+	c.JSON(http.StatusOK, gin.H{"message": "File deleted successfully", "filename": filename})
+}
+
+type renameRequest struct {
+	Name string `json:"name"`
+}
+
+// renameFurni gives a stored furni a new name: inside the JSON, in the
+// spritesheet frame names, in the archive entry names and in the store
+func renameFurni(c *gin.Context) {
+	ws := requestWorkspace(c)
+	if ws == nil {
+		return
+	}
+	filename := furniFilename(c)
+
+	var req renameRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	newName := strings.TrimSuffix(strings.TrimSpace(req.Name), ".nitro")
+	newFilename := newName + ".nitro"
+	if err := checkName(newFilename); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid furni name: " + req.Name})
+		return
+	}
+
+	// Renaming claims a name just like an upload does
+	uploadMu.Lock()
+	defer uploadMu.Unlock()
+	unlock := ws.lockFiles(filename, newFilename)
+	defer unlock()
+
+	if newFilename != filename {
+		if _, err := ws.Store.Stat(newFilename); err == nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "A furni named " + newName + " already exists", "filename": newFilename})
+			return
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			c.JSON(nitroErrorStatus(err), gin.H{"error": "Error checking existing files: " + err.Error()})
+			return
+		}
+	}
+
+	lib, err := LoadNitroLibrary(ws.Store, filename)
+	if err != nil {
+		c.JSON(nitroErrorStatus(err), gin.H{"error": "Error loading .nitro file: " + err.Error()})
+		return
+	}
+	oldName := lib.Furni.Name
+	log.Printf("[DEBUG] renameFurni: renaming %s (%s) to %s in workspace %s", filename, oldName, newName, ws.ID)
+	if err := lib.Rename(newName); err != nil {
+		log.Printf("[ERROR] renameFurni: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Error renaming furni: " + err.Error()})
+		return
+	}
+
+	// Write the new file first, so a failure leaves the old one untouched
+	if err := ws.History.EnsureBaseline(filename); err != nil {
+		log.Printf("[ERROR] renameFurni: error recording baseline revision: %v", err)
+	}
+	if err := lib.Save(ws.Store, newFilename); err != nil {
+		log.Printf("[ERROR] renameFurni: error saving nitro file: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving .nitro file: " + err.Error()})
+		return
+	}
+	if newFilename != filename {
+		if err := ws.History.Move(filename, newFilename); err != nil {
+			log.Printf("[ERROR] renameFurni: error moving revisions: %v", err)
+		}
+		if err := ws.Store.Delete(filename); err != nil {
+			log.Printf("[ERROR] renameFurni: error deleting %s: %v", filename, err)
+		}
+	}
+	revision, err := ws.History.Record(newFilename, requestAuthor(c), "rename from "+oldName)
+	if err != nil {
+		log.Printf("[ERROR] renameFurni: error recording revision: %v", err)
+	}
+	renderCache.Invalidate(ws, filename)
+
+	response := gin.H{
+		"message":  "Furni renamed successfully",
+		"filename": newFilename,
+		"name":     newName,
+	}
+	if revision != nil {
+		response["revision"] = revision.Number
+	}
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,585 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxJSONChanges caps the JSON paths reported by a revision diff
+const maxJSONChanges = 500
+
+// History keeps numbered revisions of the files in one store, saving the
+// snapshots and a revision index per file in a second store
+type History struct {
+	mu        sync.Mutex
+	files     Store
+	revisions Store
+}
+
+func NewHistory(files, revisions Store) *History {
+	return &History{files: files, revisions: revisions}
+}
+
+// Revision is one saved version of a .nitro file
+type Revision struct {
+	Number  int             `json:"number"`
+	Author  string          `json:"author"`
+	Time    time.Time       `json:"time"`
+	Action  string          `json:"action"`
+	Size    int64           `json:"size"`
+	Changes []EntryChange   `json:"changes"`
+	Entries []RevisionEntry `json:"entries"`
+}
+
+// RevisionEntry records an archive entry as it was in a revision
+type RevisionEntry struct {
+	Name  string `json:"name"`
+	Size  int    `json:"size"`
+	CRC32 uint32 `json:"crc32"`
+}
+
+// EntryChange describes how an archive entry changed between two revisions
+type EntryChange struct {
+	Name    string       `json:"name"`
+	Change  string       `json:"change"` // added, removed or modified
+	OldSize int          `json:"old_size"`
+	NewSize int          `json:"new_size"`
+	JSON    []JSONChange `json:"json_changes,omitempty"`
+}
+
+// JSONChange is a single value that differs between two JSON documents
+type JSONChange struct {
+	Path   string      `json:"path"`
+	Change string      `json:"change"` // added, removed or changed
+	Old    interface{} `json:"old,omitempty"`
+	New    interface{} `json:"new,omitempty"`
+}
+
+// RevisionDiff compares two revisions of the same file
+type RevisionDiff struct {
+	From      int           `json:"from"`
+	To        int           `json:"to"`
+	Changes   []EntryChange `json:"changes"`
+	Truncated bool          `json:"truncated,omitempty"`
+}
+
+func indexName(name string) string {
+	return name + ".revisions.json"
+}
+
+func revisionName(name string, n int) string {
+	return fmt.Sprintf("%s.%d", name, n)
+}
+
+// Revisions reads the revision index of a file, oldest first
+func (h *History) Revisions(name string) ([]Revision, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	data, err := h.revisions.Get(indexName(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return []Revision{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var revisions []Revision
+	if err := json.Unmarshal(data, &revisions); err != nil {
+		return nil, fmt.Errorf("error parsing revision index: %v", err)
+	}
+	return revisions, nil
+}
+
+func (h *History) saveRevisions(name string, revisions []Revision) error {
+	data, err := json.MarshalIndent(revisions, "", "  ")
+	if err != nil {
+		return err
+	}
+	return h.revisions.Put(indexName(name), data)
+}
+
+// revisionEntries lists the entries of a .nitro file for the revision index
+func revisionEntries(data []byte) ([]RevisionEntry, error) {
+	archive, err := parseNitroArchive(data)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []RevisionEntry{}
+	for _, file := range archive.Entries() {
+		entries = append(entries, RevisionEntry{
+			Name:  file.Name,
+			Size:  len(file.Data),
+			CRC32: crc32.ChecksumIEEE(file.Data),
+		})
+	}
+	return entries, nil
+}
+
+// diffEntries reports the entries that were added, removed or modified
+func diffEntries(from, to []RevisionEntry) []EntryChange {
+	old := make(map[string]RevisionEntry, len(from))
+	for _, entry := range from {
+		old[entry.Name] = entry
+	}
+
+	changes := []EntryChange{}
+	for _, entry := range to {
+		prev, ok := old[entry.Name]
+		switch {
+		case !ok:
+			changes = append(changes, EntryChange{Name: entry.Name, Change: "added", NewSize: entry.Size})
+		case prev.CRC32 != entry.CRC32 || prev.Size != entry.Size:
+			changes = append(changes, EntryChange{Name: entry.Name, Change: "modified", OldSize: prev.Size, NewSize: entry.Size})
+		}
+		delete(old, entry.Name)
+	}
+	for _, entry := range from {
+		if _, ok := old[entry.Name]; ok {
+			changes = append(changes, EntryChange{Name: entry.Name, Change: "removed", OldSize: entry.Size})
+		}
+	}
+	return changes
+}
+
+// Record snapshots the current contents of a file as a new revision.
+// Nothing is recorded when the contents match the latest revision.
+func (h *History) Record(name, author, action string) (*Revision, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.record(name, author, action)
+}
+
+func (h *History) record(name, author, action string) (*Revision, error) {
+	data, err := h.files.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := revisionEntries(data)
+	if err != nil {
+		return nil, err
+	}
+
+	revisions, err := h.Revisions(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var previous []RevisionEntry
+	number := 1
+	if len(revisions) > 0 {
+		last := revisions[len(revisions)-1]
+		previous = last.Entries
+		number = last.Number + 1
+	}
+	changes := diffEntries(previous, entries)
+	if len(revisions) > 0 && len(changes) == 0 {
+		return &revisions[len(revisions)-1], nil
+	}
+
+	if err := h.revisions.Put(revisionName(name, number), data); err != nil {
+		return nil, err
+	}
+
+	revision := Revision{
+		Number:  number,
+		Author:  author,
+		Time:    time.Now().UTC(),
+		Action:  action,
+		Size:    int64(len(data)),
+		Changes: changes,
+		Entries: entries,
+	}
+	revisions = append(revisions, revision)
+	if err := h.saveRevisions(name, revisions); err != nil {
+		return nil, err
+	}
+	return &revision, nil
+}
+
+// EnsureBaseline records the current file as the first revision when it
+// predates the history, so the next save can still be undone
+func (h *History) EnsureBaseline(name string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	revisions, err := h.Revisions(name)
+	if err != nil || len(revisions) > 0 {
+		return err
+	}
+	if _, err := h.files.Stat(name); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	_, err = h.record(name, "", "initial")
+	return err
+}
+
+// Read returns the .nitro contents of revision n
+func (h *History) Read(name string, n int) ([]byte, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	return h.revisions.Get(revisionName(name, n))
+}
+
+// saveWithRevision saves the library to a workspace, drops the renders of
+// the previous contents and records the result as a new revision. It only
+// fails if the file wasn't saved; the revision is nil if recording it failed.
+func saveWithRevision(lib *NitroLibrary, ws *Workspace, name, author, action string) (*Revision, error) {
+	if err := ws.History.EnsureBaseline(name); err != nil {
+		log.Printf("[ERROR] saveWithRevision: error recording baseline for %s: %v", name, err)
+	}
+	if err := lib.Save(ws.Store, name); err != nil {
+		return nil, err
+	}
+	renderCache.Invalidate(ws, name)
+	revision, err := ws.History.Record(name, author, action)
+	if err != nil {
+		log.Printf("[ERROR] saveWithRevision: error recording revision of %s: %v", name, err)
+		return nil, nil
+	}
+	return revision, nil
+}
+
+// Diff compares revisions from and to, including the JSON paths that
+// changed in JSON entries
+func (h *History) Diff(name string, from, to int) (*RevisionDiff, error) {
+	fromData, err := h.Read(name, from)
+	if err != nil {
+		return nil, err
+	}
+	toData, err := h.Read(name, to)
+	if err != nil {
+		return nil, err
+	}
+	fromArchive, err := parseNitroArchive(fromData)
+	if err != nil {
+		return nil, err
+	}
+	toArchive, err := parseNitroArchive(toData)
+	if err != nil {
+		return nil, err
+	}
+	fromEntries, _ := revisionEntries(fromData)
+	toEntries, _ := revisionEntries(toData)
+
+	diff := &RevisionDiff{From: from, To: to, Changes: diffEntries(fromEntries, toEntries)}
+	budget := maxJSONChanges
+	for i, change := range diff.Changes {
+		if change.Change != "modified" || !strings.HasSuffix(change.Name, ".json") {
+			continue
+		}
+		var a, b interface{}
+		if decodeJSONNumbers(fromArchive.Files[change.Name].Data, &a) != nil ||
+			decodeJSONNumbers(toArchive.Files[change.Name].Data, &b) != nil {
+			continue
+		}
+		changes := []JSONChange{}
+		diffJSON("", a, b, &changes, &budget)
+		diff.Changes[i].JSON = changes
+		if budget <= 0 {
+			diff.Truncated = true
+		}
+	}
+	return diff, nil
+}
+
+// decodeJSONNumbers decodes JSON keeping numbers exactly as written
+func decodeJSONNumbers(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// escapePointer escapes a key for use in a JSON pointer (RFC 6901)
+func escapePointer(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
+
+// diffJSON appends the differences between a and b under path, stopping
+// once budget changes have been reported
+func diffJSON(path string, a, b interface{}, out *[]JSONChange, budget *int) {
+	if *budget <= 0 {
+		return
+	}
+
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(av)+len(bv))
+		for k := range av {
+			keys = append(keys, k)
+		}
+		for k := range bv {
+			if _, ok := av[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			p := path + "/" + escapePointer(k)
+			old, inA := av[k]
+			cur, inB := bv[k]
+			switch {
+			case !inA:
+				*out = append(*out, JSONChange{Path: p, Change: "added", New: cur})
+				*budget--
+			case !inB:
+				*out = append(*out, JSONChange{Path: p, Change: "removed", Old: old})
+				*budget--
+			default:
+				diffJSON(p, old, cur, out, budget)
+			}
+			if *budget <= 0 {
+				return
+			}
+		}
+		return
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		for i := 0; i < len(av) || i < len(bv); i++ {
+			p := path + "/" + strconv.Itoa(i)
+			switch {
+			case i >= len(av):
+				*out = append(*out, JSONChange{Path: p, Change: "added", New: bv[i]})
+				*budget--
+			case i >= len(bv):
+				*out = append(*out, JSONChange{Path: p, Change: "removed", Old: av[i]})
+				*budget--
+			default:
+				diffJSON(p, av[i], bv[i], out, budget)
+			}
+			if *budget <= 0 {
+				return
+			}
+		}
+		return
+	default:
+		if a == b {
+			return
+		}
+	}
+
+	*out = append(*out, JSONChange{Path: path, Change: "changed", Old: a, New: b})
+	*budget--
+}
+
+// Forget deletes every revision of a file, for when the file is deleted
+func (h *History) Forget(name string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	revisions, err := h.Revisions(name)
+	if err != nil {
+		return err
+	}
+	return h.forget(name, revisions)
+}
+
+func (h *History) forget(name string, revisions []Revision) error {
+	for _, revision := range revisions {
+		err := h.revisions.Delete(revisionName(name, revision.Number))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	err := h.revisions.Delete(indexName(name))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Move carries the revisions of a file over to its new name when the file
+// is renamed
+func (h *History) Move(from, to string) error {
+	if err := checkName(to); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	revisions, err := h.Revisions(from)
+	if err != nil || len(revisions) == 0 {
+		return err
+	}
+
+	for _, revision := range revisions {
+		data, err := h.revisions.Get(revisionName(from, revision.Number))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := h.revisions.Put(revisionName(to, revision.Number), data); err != nil {
+			return err
+		}
+	}
+	if err := h.saveRevisions(to, revisions); err != nil {
+		return err
+	}
+	return h.forget(from, revisions)
+}
+
+// Revert makes revision n the current contents of a file and records that
+// as a new revision
+func (h *History) Revert(name string, n int, author string) (*Revision, error) {
+	data, err := h.Read(name, n)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := parseNitroArchive(data); err != nil {
+		return nil, fmt.Errorf("revision %d is not a valid .nitro file: %w", n, err)
+	}
+
+	if err := h.files.Put(name, data); err != nil {
+		return nil, err
+	}
+	return h.Record(name, author, fmt.Sprintf("revert to %d", n))
+}
+
+// requestAuthor identifies who made a change, from the X-User header if the
+// client sends one and otherwise the client address
+func requestAuthor(c *gin.Context) string {
+	if user := strings.TrimSpace(c.GetHeader("X-User")); user != "" {
+		return user
+	}
+	return c.ClientIP()
+}
+
+// revisionParam parses a revision number route parameter
+func revisionParam(c *gin.Context, name string) (int, bool) {
+	n, err := strconv.Atoi(c.Param(name))
+	if err != nil || n < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid revision number: " + c.Param(name)})
+		return 0, false
+	}
+	return n, true
+}
+
+// getRevisions lists the revisions of a .nitro file
+func getRevisions(c *gin.Context) {
+	ws := requestWorkspace(c)
+	if ws == nil {
+		return
+	}
+
+	filename := c.Param("filename")
+	if filepath.Ext(filename) != ".nitro" {
+		filename = filename + ".nitro"
+	}
+
+	revisions, err := ws.History.Revisions(filename)
+	if err != nil {
+		c.JSON(nitroErrorStatus(err), gin.H{"error": "Error loading revisions: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"filename": filename, "revisions": revisions})
+}
+
+// downloadRevision returns a revision as a .nitro file
+func downloadRevision(c *gin.Context) {
+	ws := requestWorkspace(c)
+	if ws == nil {
+		return
+	}
+
+	filename := c.Param("filename")
+	if filepath.Ext(filename) != ".nitro" {
+		filename = filename + ".nitro"
+	}
+	n, ok := revisionParam(c, "rev")
+	if !ok {
+		return
+	}
+
+	data, err := ws.History.Read(filename, n)
+	if err != nil {
+		c.JSON(nitroErrorStatus(err), gin.H{"error": "Error reading revision: " + err.Error()})
+		return
+	}
+
+	downloadName := fmt.Sprintf("%s_r%d.nitro", strings.TrimSuffix(filename, ".nitro"), n)
+	c.Header("Content-Disposition", "attachment; filename=\""+downloadName+"\"")
+	c.Data(http.StatusOK, "application/octet-stream", data)
+}
+
+// getRevisionDiff compares two revisions of a .nitro file
+func getRevisionDiff(c *gin.Context) {
+	ws := requestWorkspace(c)
+	if ws == nil {
+		return
+	}
+
+	filename := c.Param("filename")
+	if filepath.Ext(filename) != ".nitro" {
+		filename = filename + ".nitro"
+	}
+	from, ok := revisionParam(c, "rev")
+	if !ok {
+		return
+	}
+	to, ok := revisionParam(c, "other")
+	if !ok {
+		return
+	}
+
+	diff, err := ws.History.Diff(filename, from, to)
+	if err != nil {
+		c.JSON(nitroErrorStatus(err), gin.H{"error": "Error comparing revisions: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, diff)
+}
+
+// revertRevision restores a previous revision of a .nitro file
+func revertRevision(c *gin.Context) {
+	ws := requestWorkspace(c)
+	if ws == nil {
+		return
+	}
+
+	filename := c.Param("filename")
+	if filepath.Ext(filename) != ".nitro" {
+		filename = filename + ".nitro"
+	}
+	n, ok := revisionParam(c, "rev")
+	if !ok {
+		return
+	}
+
+	log.Printf("[DEBUG] revertRevision: reverting %s to revision %d", filename, n)
+	unlock := ws.lockFiles(filename)
+	defer unlock()
+	revision, err := ws.History.Revert(filename, n, requestAuthor(c))
+	renderCache.Invalidate(ws, filename)
+	if err != nil {
+		log.Printf("[ERROR] revertRevision: %v", err)
+		c.JSON(nitroErrorStatus(err), gin.H{"error": "Error reverting revision: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Revision restored successfully", "revision": revision})
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"xabbo.io/nx/res"
+)
+
+// libraryCacheSize is how many parsed libraries stay in memory
+var libraryCacheSize = 32
+
+// libraryCache keeps recently used libraries of every workspace parsed
+var libraryCache = NewLibraryCache(libraryCacheSize)
+
+// LoadedLibrary is a stored .nitro file parsed for rendering
+type LoadedLibrary struct {
+	Filename string
+	Lib      res.FurniLibrary
+	Furni    *NitroFurni
+	Sum      [32]byte // sha256 of the file
+}
+
+// LibraryCache is an LRU of parsed libraries. Entries are checked against
+// the size and modification time of the stored file, so a saved furni is
+// parsed again on its next use.
+type LibraryCache struct {
+	max int
+
+	mu      sync.Mutex
+	lru     *list.List // front is the most recently used
+	entries map[string]*list.Element
+}
+
+type libraryCacheEntry struct {
+	key     string
+	size    int64
+	modTime time.Time
+	loaded  *LoadedLibrary
+}
+
+func NewLibraryCache(max int) *LibraryCache {
+	return &LibraryCache{max: max, lru: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// Load returns the parsed library of a stored file, parsing it if it isn't
+// cached or changed since
+func (lc *LibraryCache) Load(ws *Workspace, filename string) (*LoadedLibrary, error) {
+	entry, err := ws.Store.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	key := renderOwner(ws, filename)
+
+	lc.mu.Lock()
+	if elem, ok := lc.entries[key]; ok {
+		cached := elem.Value.(*libraryCacheEntry)
+		if cached.size == entry.Size && cached.modTime.Equal(entry.ModTime) {
+			lc.lru.MoveToFront(elem)
+			lc.mu.Unlock()
+			return cached.loaded, nil
+		}
+	}
+	lc.mu.Unlock()
+
+	data, err := ws.Store.Get(filename)
+	if err != nil {
+		return nil, err
+	}
+	furni, err := readNitroFurni(data)
+	if err != nil {
+		return nil, err
+	}
+	lib, err := loadFurniLibrary(data)
+	if err != nil {
+		return nil, err
+	}
+	loaded := &LoadedLibrary{Filename: filename, Lib: lib, Furni: furni, Sum: sha256.Sum256(data)}
+
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if elem, ok := lc.entries[key]; ok {
+		lc.lru.Remove(elem)
+	}
+	lc.entries[key] = lc.lru.PushFront(&libraryCacheEntry{key: key, size: entry.Size, modTime: entry.ModTime, loaded: loaded})
+	for lc.lru.Len() > lc.max {
+		oldest := lc.lru.Back()
+		lc.lru.Remove(oldest)
+		delete(lc.entries, oldest.Value.(*libraryCacheEntry).key)
+	}
+	return loaded, nil
+}
+
+// WorkspaceLibraryManager is a res.LibraryManager over the furni stored in
+// a workspace: Library(name) loads name.nitro through libraryCache
+type WorkspaceLibraryManager struct {
+	ws *Workspace
+
+	mu     sync.Mutex
+	loaded map[string]*LoadedLibrary
+	added  map[string]res.FurniLibrary
+}
+
+func NewWorkspaceLibraryManager(ws *Workspace) *WorkspaceLibraryManager {
+	return &WorkspaceLibraryManager{
+		ws:     ws,
+		loaded: make(map[string]*LoadedLibrary),
+		added:  make(map[string]res.FurniLibrary),
+	}
+}
+
+// Load returns the library of a stored file by its file name. A manager keeps
+// what it loaded, so one render sees one version of a file. Libraries aren't
+// looked up by their furni name: a renamed copy keeps the name of its original.
+func (m *WorkspaceLibraryManager) Load(name string) (*LoadedLibrary, error) {
+	filename := name
+	if !strings.HasSuffix(filename, ".nitro") {
+		filename += ".nitro"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if loaded, ok := m.loaded[filename]; ok {
+		return loaded, nil
+	}
+	loaded, err := libraryCache.Load(m.ws, filename)
+	if err != nil {
+		return nil, err
+	}
+	m.loaded[filename] = loaded
+	return loaded, nil
+}
+
+func (m *WorkspaceLibraryManager) Library(name string) res.AssetLibrary {
+	m.mu.Lock()
+	lib, ok := m.added[name]
+	m.mu.Unlock()
+	if ok {
+		return lib
+	}
+	loaded, err := m.Load(name)
+	if err != nil {
+		return nil
+	}
+	return loaded.Lib
+}
+
+func (m *WorkspaceLibraryManager) Libraries() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := []string{}
+	seen := make(map[string]bool)
+	for _, loaded := range m.loaded {
+		if name := loaded.Lib.Name(); !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for name := range m.added {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (m *WorkspaceLibraryManager) LibraryExists(name string) bool {
+	return m.Library(name) != nil
+}
+
+// AddLibrary makes a library that isn't stored, or an edited copy of one,
+// available under its name
+func (m *WorkspaceLibraryManager) AddLibrary(lib res.AssetLibrary) bool {
+	furniLib, ok := lib.(res.FurniLibrary)
+	if !ok {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.added[furniLib.Name()] = furniLib
+	return true
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"log"
+	"math"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Lint severities and categories
+const (
+	lintError   = "error"
+	lintWarning = "warning"
+
+	lintBrokenReference = "broken_reference"
+	lintOrphanFrame     = "orphan_frame"
+	lintOrphanAsset     = "orphan_asset"
+	lintUnusedArea      = "unused_png_area"
+)
+
+// lintUnusedAreaLimit is the share of the PNG left uncovered by frames above
+// which the linter warns
+const lintUnusedAreaLimit = 0.5
+
+// LintIssue is a problem found by the linter, at a JSON pointer of the furni
+type LintIssue struct {
+	Severity string `json:"severity"`
+	Category string `json:"category"`
+	Pointer  string `json:"pointer"`
+	Message  string `json:"message"`
+}
+
+// LintReport lists the issues of a furni, errors first
+type LintReport struct {
+	Errors   int         `json:"errors"`
+	Warnings int         `json:"warnings"`
+	Issues   []LintIssue `json:"issues"`
+}
+
+func (r *LintReport) add(severity, category, pointer, format string, args ...interface{}) {
+	r.Issues = append(r.Issues, LintIssue{
+		Severity: severity,
+		Category: category,
+		Pointer:  pointer,
+		Message:  fmt.Sprintf(format, args...),
+	})
+	if severity == lintError {
+		r.Errors++
+	} else {
+		r.Warnings++
+	}
+}
+
+// sortedKeys returns the keys of m, numeric keys in numeric order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return numericLess(keys[i], keys[j]) })
+	return keys
+}
+
+// spriteFrame returns the spritesheet frame of an asset or source name.
+// Frames are named like their assets; some exporters prefix the furni name.
+func (f *NitroFurni) spriteFrame(name string) (string, bool) {
+	if _, ok := f.Spritesheet.Frames[name]; ok {
+		return name, true
+	}
+	if prefixed := f.Name + "_" + name; f.Name != "" {
+		if _, ok := f.Spritesheet.Frames[prefixed]; ok {
+			return prefixed, true
+		}
+	}
+	return "", false
+}
+
+// visDirections returns the directions of a visualization: its own, or the
+// logic directions when it has none
+func (f *NitroFurni) visDirections(vis *NitroVisualization) []int {
+	var directions []int
+	for key := range vis.Directions {
+		if d, err := strconv.Atoi(key); err == nil {
+			directions = append(directions, d)
+		}
+	}
+	if len(directions) == 0 {
+		directions = append(directions, f.Logic.Model.Directions...)
+	}
+	sort.Ints(directions)
+	return directions
+}
+
+// layerFrames returns the frame ids layer shows in vis: 0, the frame of
+// states without animation, and every frame of its animations
+func layerFrames(vis *NitroVisualization, layer int) []int {
+	ids := map[int]bool{0: true}
+	for _, anim := range vis.Animations {
+		for _, seq := range anim.Layers[strconv.Itoa(layer)].FrameSequences {
+			for _, frame := range seq.Frames {
+				ids[frame.Id] = true
+			}
+		}
+	}
+	frames := make([]int, 0, len(ids))
+	for id := range ids {
+		frames = append(frames, id)
+	}
+	sort.Ints(frames)
+	return frames
+}
+
+// assetName is the name of the asset of a layer frame in one direction
+func (f *NitroFurni) assetName(size, layer, direction, frame int) string {
+	return fmt.Sprintf("%s_%d_%c_%d_%d", f.Name, size, 'a'+layer, direction, frame)
+}
+
+// usedAssets returns the assets a visualization can show: the frames of its
+// layers in each direction, shadows, icons, and the assets these take their
+// image from
+func (f *NitroFurni) usedAssets() map[string]bool {
+	used := make(map[string]bool)
+	for i := range f.Visualizations {
+		vis := &f.Visualizations[i]
+		directions := f.visDirections(vis)
+		for layer := 0; layer < vis.LayerCount && layer < 26; layer++ {
+			for _, frame := range layerFrames(vis, layer) {
+				for _, d := range directions {
+					used[f.assetName(vis.Size, layer, d, frame)] = true
+				}
+			}
+		}
+		for _, d := range directions {
+			used[fmt.Sprintf("%s_%d_sd_%d_0", f.Name, vis.Size, d)] = true
+		}
+	}
+	for name := range f.Assets {
+		if strings.HasPrefix(name, f.Name+"_icon_") {
+			used[name] = true
+		}
+	}
+	for name := range used {
+		if asset, ok := f.Assets[name]; ok && asset.Source != "" {
+			used[asset.Source] = true
+		}
+	}
+	for _, alias := range f.Aliases {
+		used[alias.Link] = true
+	}
+	return used
+}
+
+// referencedFrames returns the spritesheet frames used by some asset
+func (f *NitroFurni) referencedFrames() map[string]bool {
+	referenced := make(map[string]bool)
+	for name, asset := range f.Assets {
+		if asset.Source != "" {
+			name = asset.Source
+		}
+		if frame, ok := f.spriteFrame(name); ok {
+			referenced[frame] = true
+		}
+	}
+	return referenced
+}
+
+// layerAsset splits the name of a layer or shadow asset,
+// name_size_layer_direction_frame. ok is false for other names.
+func (f *NitroFurni) layerAsset(name string) (size int, layer string, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(name, f.Name+"_"), "_")
+	if len(parts) != 4 || !strings.HasPrefix(name, f.Name+"_") {
+		return 0, "", false
+	}
+	for _, i := range []int{2, 3} {
+		if _, err := strconv.Atoi(parts[i]); err != nil {
+			return 0, "", false
+		}
+	}
+	size, err := strconv.Atoi(parts[0])
+	return size, parts[1], err == nil
+}
+
+// LintLibrary checks the references between the assets, spritesheet
+// frames and visualizations of a furni, and how much of its PNG is used
+func LintLibrary(lib *NitroLibrary) *LintReport {
+	furni := lib.Furni
+	report := &LintReport{Issues: []LintIssue{}}
+
+	// Assets and their frames
+	for _, name := range sortedKeys(furni.Assets) {
+		asset := furni.Assets[name]
+		pointer := "/assets/" + pointerEscaper.Replace(name)
+		if asset.Source != "" {
+			if _, ok := furni.spriteFrame(asset.Source); !ok {
+				report.add(lintError, lintBrokenReference, pointer+"/source",
+					"source %s of asset %s has no spritesheet frame", asset.Source, name)
+			}
+		} else if _, ok := furni.spriteFrame(name); !ok {
+			report.add(lintError, lintBrokenReference, pointer, "asset %s has no spritesheet frame", name)
+		}
+	}
+	for _, name := range sortedKeys(furni.Aliases) {
+		link := furni.Aliases[name].Link
+		if _, ok := furni.Assets[link]; !ok {
+			report.add(lintError, lintBrokenReference, "/aliases/"+pointerEscaper.Replace(name)+"/link",
+				"alias %s links to missing asset %s", name, link)
+		}
+	}
+
+	// Visualizations
+	for i := range furni.Visualizations {
+		lintVisualization(furni, i, report)
+	}
+
+	used := furni.usedAssets()
+	for _, name := range sortedKeys(furni.Assets) {
+		if _, _, ok := furni.layerAsset(name); ok && !used[name] {
+			report.add(lintWarning, lintOrphanAsset, "/assets/"+pointerEscaper.Replace(name),
+				"asset %s isn't shown by any visualization", name)
+		}
+	}
+	referenced := furni.referencedFrames()
+	for _, name := range sortedKeys(furni.Spritesheet.Frames) {
+		if !referenced[name] {
+			report.add(lintWarning, lintOrphanFrame, "/spritesheet/frames/"+pointerEscaper.Replace(name),
+				"frame %s isn't used by any asset", name)
+		}
+	}
+
+	lintSpritesheetArea(lib, report)
+
+	sort.SliceStable(report.Issues, func(i, j int) bool {
+		a, b := report.Issues[i], report.Issues[j]
+		if a.Severity != b.Severity {
+			return a.Severity == lintError
+		}
+		return a.Category < b.Category
+	})
+	return report
+}
+
+// lintVisualization checks the layer indexes, animation frames and
+// transitions of visualization i
+func lintVisualization(furni *NitroFurni, i int, report *LintReport) {
+	vis := &furni.Visualizations[i]
+	base := fmt.Sprintf("/visualizations/%d", i)
+	beyond := func(pointer, key, what string) bool {
+		layer, err := strconv.Atoi(key)
+		if err != nil || layer < vis.LayerCount {
+			return false
+		}
+		report.add(lintError, lintBrokenReference, pointer,
+			"%s layer %d, beyond layerCount %d", what, layer, vis.LayerCount)
+		return true
+	}
+
+	for _, key := range sortedKeys(vis.Layers) {
+		beyond(base+"/layers/"+key, key, "properties for")
+	}
+	for _, d := range sortedKeys(vis.Directions) {
+		for _, key := range sortedKeys(vis.Directions[d].Layers) {
+			beyond(base+"/directions/"+d+"/layers/"+key, key, "direction "+d+" overrides")
+		}
+	}
+	for _, c := range sortedKeys(vis.Colors) {
+		for _, key := range sortedKeys(vis.Colors[c].Layers) {
+			beyond(base+"/colors/"+c+"/layers/"+key, key, "color "+c+" tints")
+		}
+	}
+
+	directions := furni.visDirections(vis)
+	for _, a := range sortedKeys(vis.Animations) {
+		anim := vis.Animations[a]
+		animPointer := base + "/animations/" + a
+		transitions := []struct {
+			key    string
+			target *int
+		}{{"transitionTo", anim.TransitionTo}, {"transitionFrom", anim.TransitionFrom}}
+		for _, t := range transitions {
+			if t.target == nil {
+				continue
+			}
+			if _, ok := vis.Animations[strconv.Itoa(*t.target)]; !ok {
+				report.add(lintError, lintBrokenReference, animPointer+"/"+t.key,
+					"animation %s has %s %d, which isn't an animation", a, t.key, *t.target)
+			}
+		}
+
+		for _, key := range sortedKeys(anim.Layers) {
+			layerPointer := animPointer + "/layers/" + key
+			if beyond(layerPointer, key, "animation "+a+" animates") {
+				continue
+			}
+			layer, err := strconv.Atoi(key)
+			if err != nil {
+				continue
+			}
+			// Report each frame id once per animation layer
+			checked := make(map[int]bool)
+			seqs := anim.Layers[key].FrameSequences
+			for _, s := range sortedKeys(seqs) {
+				for _, f := range sortedKeys(seqs[s].Frames) {
+					id := seqs[s].Frames[f].Id
+					if checked[id] {
+						continue
+					}
+					checked[id] = true
+					var missing []string
+					for _, d := range directions {
+						if _, ok := furni.Assets[furni.assetName(vis.Size, layer, d, id)]; !ok {
+							missing = append(missing, strconv.Itoa(d))
+						}
+					}
+					pointer := layerPointer + "/frameSequences/" + s + "/frames/" + f + "/id"
+					switch {
+					case len(missing) == 0:
+					case len(missing) == len(directions):
+						report.add(lintError, lintBrokenReference, pointer,
+							"frame id %d has no asset, e.g. %s", id, furni.assetName(vis.Size, layer, directions[0], id))
+					default:
+						report.add(lintWarning, lintBrokenReference, pointer,
+							"frame id %d has no asset for directions %s", id, strings.Join(missing, ", "))
+					}
+				}
+			}
+		}
+	}
+}
+
+// lintSpritesheetArea checks that the spritesheet frames lie within the PNG
+// and warns when much of the PNG isn't covered by any frame
+func lintSpritesheetArea(lib *NitroLibrary, report *LintReport) {
+	furni := lib.Furni
+	imageName := furni.Spritesheet.Meta.Image
+	file, ok := lib.Archive.Files[imageName]
+	if imageName == "" || !ok {
+		report.add(lintError, lintBrokenReference, "/spritesheet/meta/image",
+			"spritesheet image %q isn't in the archive", imageName)
+		return
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(file.Data))
+	if err != nil {
+		report.add(lintError, lintBrokenReference, "/spritesheet/meta/image",
+			"spritesheet image %s can't be decoded: %v", imageName, err)
+		return
+	}
+
+	sheet := image.Rect(0, 0, config.Width, config.Height)
+	var rects []image.Rectangle
+	var bounds image.Rectangle
+	for _, name := range sortedKeys(furni.Spritesheet.Frames) {
+		frame := furni.Spritesheet.Frames[name]
+		f := frame.Frame
+		rect := image.Rect(f.X, f.Y, f.X+f.W, f.Y+f.H)
+		if frame.Rotated {
+			rect = image.Rect(f.X, f.Y, f.X+f.H, f.Y+f.W)
+		}
+		if !rect.In(sheet) {
+			report.add(lintError, lintBrokenReference, "/spritesheet/frames/"+pointerEscaper.Replace(name)+"/frame",
+				"frame %s lies outside the %dx%d PNG", name, sheet.Dx(), sheet.Dy())
+		}
+		rect = rect.Intersect(sheet)
+		bounds = bounds.Union(rect)
+		rects = append(rects, rect)
+	}
+
+	if sheet.Empty() {
+		return
+	}
+	unused := 1 - float64(unionArea(rects))/(float64(sheet.Dx())*float64(sheet.Dy()))
+	if bounds.Max != sheet.Max {
+		report.add(lintWarning, lintUnusedArea, "/spritesheet/meta/image",
+			"the frames fit in %dx%d of the %dx%d PNG", bounds.Max.X, bounds.Max.Y, sheet.Dx(), sheet.Dy())
+	}
+	if unused > lintUnusedAreaLimit {
+		report.add(lintWarning, lintUnusedArea, "/spritesheet/meta/image",
+			"%.0f%% of the %dx%d PNG isn't covered by any frame", unused*100, sheet.Dx(), sheet.Dy())
+	}
+}
+
+// unionArea returns the area rects cover together. The PNG header decides
+// how large a sheet claims to be, so it sweeps the rectangles instead of
+// marking pixels.
+func unionArea(rects []image.Rectangle) int {
+	var xs []int
+	for _, r := range rects {
+		if !r.Empty() {
+			xs = append(xs, r.Min.X, r.Max.X)
+		}
+	}
+	sort.Ints(xs)
+	area := 0
+	for i := 0; i+1 < len(xs); i++ {
+		if xs[i] == xs[i+1] {
+			continue
+		}
+		// The rectangles across this column, merged top to bottom
+		var spans [][2]int
+		for _, r := range rects {
+			if !r.Empty() && r.Min.X <= xs[i] && r.Max.X >= xs[i+1] {
+				spans = append(spans, [2]int{r.Min.Y, r.Max.Y})
+			}
+		}
+		sort.Slice(spans, func(a, b int) bool { return spans[a][0] < spans[b][0] })
+		height, end := 0, math.MinInt
+		for _, span := range spans {
+			if span[1] <= end {
+				continue
+			}
+			height += span[1] - max(span[0], end)
+			end = span[1]
+		}
+		area += height * (xs[i+1] - xs[i])
+	}
+	return area
+}
+
+// lintFurni lints a stored furni
+func lintFurni(c *gin.Context) {
+	ws := requestWorkspace(c)
+	if ws == nil {
+		return
+	}
+
+	filename := c.Param("filename")
+	if filepath.Ext(filename) != ".nitro" {
+		filename = filename + ".nitro"
+	}
+
+	lib, err := LoadNitroLibrary(ws.Store, filename)
+	if err != nil {
+		log.Printf("[ERROR] lintFurni: error loading nitro library: %v", err)
+		c.JSON(nitroErrorStatus(err), gin.H{"error": "Error loading .nitro file: " + err.Error()})
+		return
+	}
+	report := LintLibrary(lib)
+	log.Printf("[DEBUG] lintFurni: %s has %d errors and %d warnings", filename, report.Errors, report.Warnings)
+	c.JSON(http.StatusOK, report)
+}
@@ -1,21 +1,36 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+// workspaces holds the uploaded .nitro files. The default workspace keeps
+// them in ../uploads and serves the unscoped /api routes.
+var workspaces = NewWorkspaces("../workspaces",
+	newLocalWorkspace("../uploads", defaultWorkspaceID, "Default", time.Time{}))
+
 func main() {
 	// Crear directorio de uploads si no existe
 	os.MkdirAll("../uploads", 0755)
 	os.MkdirAll("../static", 0755)
+	os.MkdirAll("../workspaces", 0755)
+	if err := workspaces.Load(); err != nil {
+		log.Printf("[ERROR] main: error loading workspaces: %v", err)
+	}
 
 	// Configurar Gin
 	r := gin.Default()
@@ -33,8 +48,12 @@ func main() {
 		c.Next()
 	})
 
-	// Serve static files
-	r.Static("/static", "../static")
+	// Serve static files; renders go through the cache for ETags
+	if err := renderCache.Load(); err != nil {
+		log.Printf("[ERROR] main: error loading render cache: %v", err)
+	}
+	r.GET("/static/*filepath", renderCache.serveStatic)
+	r.HEAD("/static/*filepath", renderCache.serveStatic)
 	r.Static("/uploads", "../uploads")
 
 	// Servir frontend
@@ -45,26 +64,167 @@ func main() {
 	api := r.Group("/api")
 	{
 		api.POST("/upload", uploadNitroFile)
+		api.GET("/furni", listFurni)
+		api.DELETE("/furni/:filename", deleteFurni)
+		api.POST("/furni/:filename/rename", renameFurni)
 		api.POST("/render", renderFurni)
+		api.POST("/render/batch", renderBatch)
+		api.POST("/render/sheet", renderSheet)
+		api.POST("/render/scene", renderScene)
+		api.POST("/render/preview", renderPreview)
 		api.GET("/info/:filename", getFurniInfo)
 		api.GET("/json/:filename", getNitroJSON)
 		api.PUT("/json/:filename", updateNitroJSON)
+		api.PATCH("/json/:filename", patchNitroJSON)
 		api.GET("/png/:filename", getNitroPNG)
 		api.PUT("/png/:filename", updateNitroPNG)
 
 		api.GET("/png-original/:filename", getNitroPNGOriginal)
 		api.GET("/details/:filename", getDetailedInfo)
 		api.GET("/export/:filename", exportNitroFile)
+		api.GET("/backups/:filename", getNitroBackups)
+		api.POST("/backups/:filename/:index/restore", restoreNitroBackup)
+		api.GET("/revisions/:filename", getRevisions)
+		api.GET("/revisions/:filename/:rev", downloadRevision)
+		api.GET("/revisions/:filename/:rev/diff/:other", getRevisionDiff)
+		api.POST("/revisions/:filename/:rev/revert", revertRevision)
+
+		api.POST("/validate", validateJSON)
+		api.GET("/lint/:filename", lintFurni)
+		api.POST("/fix/:filename", fixFurni)
+		api.GET("/workspaces", listWorkspaces)
+		api.POST("/workspaces", createWorkspace)
+		api.POST("/workspaces/:ws/rename", renameWorkspace)
+		api.DELETE("/workspaces/:ws", deleteWorkspace)
+		api.GET("/workspaces/:ws/export", exportWorkspace)
+	}
+
+	// Las mismas rutas, dentro de un workspace
+	ws := api.Group("/workspaces/:ws")
+	{
+		ws.POST("/furni", uploadNitroFile)
+		ws.GET("/furni", listFurni)
+		ws.DELETE("/furni/:filename", deleteFurni)
+		ws.POST("/furni/:filename/rename", renameFurni)
+		ws.POST("/render", renderFurni)
+		ws.POST("/render/batch", renderBatch)
+		ws.POST("/render/sheet", renderSheet)
+		ws.POST("/render/scene", renderScene)
+		ws.POST("/render/preview", renderPreview)
+		ws.GET("/furni/:filename/info", getFurniInfo)
+		ws.GET("/furni/:filename/json", getNitroJSON)
+		ws.PUT("/furni/:filename/json", updateNitroJSON)
+		ws.PATCH("/furni/:filename/json", patchNitroJSON)
+		ws.GET("/furni/:filename/png", getNitroPNG)
+		ws.PUT("/furni/:filename/png", updateNitroPNG)
+
+		ws.GET("/furni/:filename/png-original", getNitroPNGOriginal)
+		ws.GET("/furni/:filename/details", getDetailedInfo)
+		ws.GET("/furni/:filename/lint", lintFurni)
+		ws.POST("/furni/:filename/fix", fixFurni)
+		ws.GET("/furni/:filename/export", exportNitroFile)
+		ws.GET("/furni/:filename/backups", getNitroBackups)
+		ws.POST("/furni/:filename/backups/:index/restore", restoreNitroBackup)
+		ws.GET("/furni/:filename/revisions", getRevisions)
+		ws.GET("/furni/:filename/revisions/:rev", downloadRevision)
+		ws.GET("/furni/:filename/revisions/:rev/diff/:other", getRevisionDiff)
+		ws.POST("/furni/:filename/revisions/:rev/revert", revertRevision)
 	}
 
 	log.Println("Servidor iniciado en http://localhost:7777")
 	r.Run(":7777")
 }
 
-// uploadNitroFile handles .nitro file uploads
+// maxUploadSize caps upload bodies, leaving room for multipart overhead
+var maxUploadSize = DefaultNitroLimits.MaxArchiveCompressed + 1<<20
+
+// nitroErrorStatus maps errors from loading a .nitro file to an HTTP status:
+// 404 for missing files, 413 for archives over the reader limits, 400 for
+// malformed input, names or render parameters and 500 for everything else
+func nitroErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, ErrInvalidName):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrEntryTooLarge),
+		errors.Is(err, ErrArchiveTooLarge),
+		errors.Is(err, ErrTooManyEntries):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrInvalidRender),
+		errors.Is(err, ErrTruncatedArchive),
+		errors.Is(err, ErrCorruptEntry),
+		errors.Is(err, ErrDuplicateEntry),
+		errors.Is(err, ErrInvalidEntryName):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// Policies for an upload whose name is already taken by a stored furni
+const (
+	conflictReject    = "reject"    // fail with 409 Conflict
+	conflictOverwrite = "overwrite" // replace the stored furni
+	conflictRename    = "rename"    // store under the next free name_N.nitro
+)
+
+// uploadMu keeps name resolution and the write of an upload together, so two
+// concurrent uploads can't both claim the same free name
+var uploadMu sync.Mutex
+
+// errNameConflict is returned by resolveUploadName under conflictReject
+var errNameConflict = errors.New("a furni with this name already exists")
+
+// resolveUploadName picks the stored name for an upload under policy and
+// reports whether the requested name was already taken
+func resolveUploadName(store Store, name, policy string) (string, bool, error) {
+	_, err := store.Stat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return name, false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	switch policy {
+	case conflictOverwrite:
+		return name, true, nil
+	case conflictRename:
+		base := strings.TrimSuffix(name, ".nitro")
+		for n := 2; n < 1000; n++ {
+			candidate := fmt.Sprintf("%s_%d.nitro", base, n)
+			_, err := store.Stat(candidate)
+			if errors.Is(err, fs.ErrNotExist) {
+				return candidate, true, nil
+			}
+			if err != nil {
+				return "", true, err
+			}
+		}
+		return "", true, fmt.Errorf("no free name left for %s", name)
+	}
+	return "", true, errNameConflict
+}
+
+// uploadNitroFile handles .nitro file uploads. The on_conflict form field or
+// query parameter chooses what happens when the furni name is already taken:
+// reject (default), overwrite or rename.
 func uploadNitroFile(c *gin.Context) {
+	ws := requestWorkspace(c)
+	if ws == nil {
+		return
+	}
+
+	// Reject oversized bodies before anything is written to disk
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxUploadSize)
+
 	file, err := c.FormFile("file")
 	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File too large"})
+			return
+		}
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Could not get file"})
 		return
 	}
@@ -75,47 +235,110 @@ func uploadNitroFile(c *gin.Context) {
 		return
 	}
 
-	// Save file temporarily with original name
-	tempFilename := filepath.Base(file.Filename)
-	tempFilepath := filepath.Join("../uploads", tempFilename)
+	policy := c.DefaultPostForm("on_conflict", c.DefaultQuery("on_conflict", conflictReject))
+	if policy != conflictReject && policy != conflictOverwrite && policy != conflictRename {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "on_conflict must be reject, overwrite or rename"})
+		return
+	}
 
-	if err := c.SaveUploadedFile(file, tempFilepath); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving file"})
+	// Read the upload into memory; nothing touches the store until it parses
+	src, err := file.Open()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading file"})
+		return
+	}
+	data, err := io.ReadAll(src)
+	src.Close()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading file"})
 		return
 	}
 
 	// Process .nitro file to get information and internal name
-	info, err := processNitroFile(tempFilepath)
+	info, err := processNitroData(filepath.Base(file.Filename), data)
 	if err != nil {
-		// Remove temp file on error
-		os.Remove(tempFilepath)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error processing file: " + err.Error()})
+		c.JSON(nitroErrorStatus(err), gin.H{"error": "Error processing file: " + err.Error()})
 		return
 	}
 
-	// Use internal name from JSON if available, otherwise use original filename
-	finalFilename := info.Name + ".nitro"
-	finalFilepath := filepath.Join("../uploads", finalFilename)
+	// Use internal name from JSON if available, otherwise use original filename.
+	// The name comes from inside the archive, so it must be a plain file name.
+	requestedFilename := info.Name + ".nitro"
+	if err := checkName(requestedFilename); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid furni name: " + info.Name})
+		return
+	}
 
-	// If the final filename is different from temp, rename the file
-	if tempFilename != finalFilename {
-		if err := os.Rename(tempFilepath, finalFilepath); err != nil {
-			// If rename fails, remove temp file
-			os.Remove(tempFilepath)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error renaming file"})
+	uploadMu.Lock()
+	finalFilename, conflict, err := resolveUploadName(ws.Store, requestedFilename, policy)
+	if err != nil {
+		uploadMu.Unlock()
+		if errors.Is(err, errNameConflict) {
+			c.JSON(http.StatusConflict, gin.H{
+				"error":    "A furni named " + info.Name + " already exists",
+				"filename": requestedFilename,
+				"policy":   policy,
+			})
 			return
 		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error checking existing files: " + err.Error()})
+		return
 	}
+	log.Printf("[DEBUG] uploadNitroFile: storing %s as %s in workspace %s (conflict: %v, policy: %s)", requestedFilename, finalFilename, ws.ID, conflict, policy)
 
-	c.JSON(http.StatusOK, gin.H{
-		"filename": finalFilename,
-		"info":     info,
-		"message":  "File uploaded successfully",
-	})
+	// Keep whatever is being replaced in the history of the furni
+	unlock := ws.lockFiles(finalFilename)
+	if err := ws.History.EnsureBaseline(finalFilename); err != nil {
+		log.Printf("[ERROR] uploadNitroFile: error recording baseline revision: %v", err)
+	}
+
+	err = ws.Store.Put(finalFilename, data)
+	uploadMu.Unlock()
+	if err != nil {
+		unlock()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving file"})
+		return
+	}
+	if conflict && finalFilename == requestedFilename {
+		renderCache.Invalidate(ws, finalFilename)
+	}
+
+	// Record the upload before another writer can change the file
+	revision, err := ws.History.Record(finalFilename, requestAuthor(c), "upload")
+	unlock()
+	if err != nil {
+		log.Printf("[ERROR] uploadNitroFile: error recording revision: %v", err)
+	}
+
+	response := gin.H{
+		"filename":           finalFilename,
+		"requested_filename": requestedFilename,
+		"conflict":           conflict,
+		"policy":             policy,
+		"info":               info,
+		"message":            "File uploaded successfully",
+	}
+	if revision != nil {
+		response["revision"] = revision.Number
+	}
+	// Lint on request; problems don't stop the upload
+	if c.DefaultPostForm("lint", c.DefaultQuery("lint", "false")) == "true" {
+		if lib, err := ParseNitroLibrary(data); err != nil {
+			log.Printf("[ERROR] uploadNitroFile: error parsing %s for lint: %v", finalFilename, err)
+		} else {
+			response["lint"] = LintLibrary(lib)
+		}
+	}
+	c.JSON(http.StatusOK, response)
 }
 
 // renderFurni renderiza el mueble con parámetros específicos
 func renderFurni(c *gin.Context) {
+	ws := requestWorkspace(c)
+	if ws == nil {
+		return
+	}
+
 	var req RenderRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		log.Printf("[ERROR] renderFurni: error binding JSON: %v", err)
@@ -125,22 +348,24 @@ func renderFurni(c *gin.Context) {
 
 	log.Printf("[DEBUG] renderFurni: processing request %+v", req)
 
-	// Render GIF
-	gifPath, err := renderFurniToGIF(req)
+	output, err := renderFurniFile(ws, req)
 	if err != nil {
-		log.Printf("[ERROR] renderFurni: error rendering GIF: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error rendering: " + err.Error()})
+		log.Printf("[ERROR] renderFurni: error rendering %s: %v", req.Format, err)
+		c.JSON(nitroErrorStatus(err), gin.H{"error": "Error rendering: " + err.Error()})
 		return
 	}
 
-	log.Printf("[DEBUG] renderFurni: successfully rendered GIF to %s", gifPath)
-	c.JSON(http.StatusOK, gin.H{
-		"gif_url": "/static/" + filepath.Base(gifPath),
-	})
+	log.Printf("[DEBUG] renderFurni: successfully rendered %s to %s", output.Format, output.Filename)
+	c.JSON(http.StatusOK, renderResponse(output))
 }
 
 // getFurniInfo obtiene información del mueble
 func getFurniInfo(c *gin.Context) {
+	ws := requestWorkspace(c)
+	if ws == nil {
+		return
+	}
+
 	filename := c.Param("filename")
 	
 	// Asegurar que el filename tenga la extensión .nitro
@@ -148,13 +373,11 @@ func getFurniInfo(c *gin.Context) {
 		filename = filename + ".nitro"
 	}
 	
-	filepath := filepath.Join("../uploads", filename)
-
-	log.Printf("[DEBUG] getFurniInfo processing file: %s", filepath)
-	info, err := processNitroFile(filepath)
+	log.Printf("[DEBUG] getFurniInfo processing file: %s", filename)
+	info, err := processNitroFile(ws.Store, filename)
 	if err != nil {
 		log.Printf("[ERROR] getFurniInfo: error processing file: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error processing file: " + err.Error()})
+		c.JSON(nitroErrorStatus(err), gin.H{"error": "Error processing file: " + err.Error()})
 		return
 	}
 
@@ -168,9 +391,65 @@ type RenderRequest struct {
 	State     int    `json:"state"`
 	Size      int    `json:"size"`
 	Color     int    `json:"color"`
+	// Format is gif (default), png, apng or strip
+	Format string `json:"format,omitempty"`
+	Shadow bool   `json:"shadow,omitempty"`
+	// Background is a color (#rrggbb, #rrggbbaa, transparent) or floor for a
+	// room floor tile under the furni, optionally colored: floor:#rrggbb
+	Background string `json:"background,omitempty"`
+	// Scale enlarges the render 1 to 8 times without smoothing
+	Scale int `json:"scale,omitempty"`
+	// Padding adds pixels of background around the scaled render
+	Padding int `json:"padding,omitempty"`
+	// StartFrame is the first animation frame rendered
+	StartFrame int `json:"start_frame,omitempty"`
+	// FrameCount overrides the number of frames; "auto" renders one whole
+	// loop of every layer
+	FrameCount FrameCount `json:"frame_count,omitempty"`
+	// FPS or DelayMs (which wins) override the frame rate
+	FPS     int `json:"fps,omitempty"`
+	DelayMs int `json:"delay_ms,omitempty"`
+	// LoopCount is how many times the animation plays, 0 for forever
+	LoopCount *int `json:"loop_count,omitempty"`
+	// FromState renders the switch from FromState to State: the transitions
+	// leading to State, then the State loop
+	FromState *int `json:"from_state,omitempty"`
+	// Strict fails the render instead of falling back to another direction,
+	// a static state or the default colors
+	Strict bool `json:"strict,omitempty"`
+}
+
+// renderResponse lists the URLs of a render. GIFs keep their gif_url.
+func renderResponse(output *RenderOutput) gin.H {
+	warnings := output.Warnings
+	if warnings == nil {
+		warnings = []string{}
+	}
+	response := gin.H{
+		"url":         "/static/" + output.Filename,
+		"format":      output.Format,
+		"direction":   output.Direction,
+		"state":       output.State,
+		"color":       output.Color,
+		"frame_count": output.FrameCount,
+		"warnings":    warnings,
+	}
+	if output.Format == formatGIF {
+		response["gif_url"] = response["url"]
+	}
+	if output.Timing != nil {
+		response["timing"] = output.Timing
+		response["timing_url"] = "/static/" + output.TimingFile
+	}
+	return response
 }
 
 func getNitroJSON(c *gin.Context) {
+	ws := requestWorkspace(c)
+	if ws == nil {
+		return
+	}
+
 	filename := c.Param("filename")
 	if filename == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Filename is required"})
@@ -183,12 +462,11 @@ func getNitroJSON(c *gin.Context) {
 	}
 
 	// Load .nitro file
-	nitroPath := filepath.Join("../uploads", filename)
-	log.Printf("[DEBUG] updateNitroPNG: loading nitro file from %s", nitroPath)
-	lib, err := LoadNitroLibrary(nitroPath)
+	log.Printf("[DEBUG] updateNitroPNG: loading nitro file %s", filename)
+	lib, err := LoadNitroLibrary(ws.Store, filename)
 	if err != nil {
 		log.Printf("[ERROR] updateNitroPNG: error loading nitro library: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error loading .nitro file: " + err.Error()})
+		c.JSON(nitroErrorStatus(err), gin.H{"error": "Error loading .nitro file: " + err.Error()})
 		return
 	}
 
@@ -204,6 +482,11 @@ func getNitroJSON(c *gin.Context) {
 }
 
 func updateNitroJSON(c *gin.Context) {
+	ws := requestWorkspace(c)
+	if ws == nil {
+		return
+	}
+
 	filename := c.Param("filename")
 	if filename == "" {
 		log.Printf("[ERROR] updateNitroJSON: filename is required")
@@ -235,20 +518,28 @@ func updateNitroJSON(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "JSON inválido: " + err.Error()})
 		return
 	}
+	// Validar contra el esquema del furni
+	problems, _ := ValidateFurniJSON(jsonContent)
+	if len(problems) > 0 {
+		log.Printf("[ERROR] updateNitroJSON: %d schema errors, first: %v", len(problems), problems[0])
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid furni JSON: " + problems[0].Error(), "errors": problems})
+		return
+	}
 
 	// Load .nitro file
-	nitroPath := filepath.Join("../uploads", filename)
-	log.Printf("[DEBUG] updateNitroJSON: loading nitro file from %s", nitroPath)
-	lib, err := LoadNitroLibrary(nitroPath)
+	log.Printf("[DEBUG] updateNitroJSON: loading nitro file %s", filename)
+	unlock := ws.lockFiles(filename)
+	defer unlock()
+	lib, err := LoadNitroLibrary(ws.Store, filename)
 	if err != nil {
 		log.Printf("[ERROR] updateNitroJSON: error loading nitro library: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error loading .nitro file: " + err.Error()})
+		c.JSON(nitroErrorStatus(err), gin.H{"error": "Error loading .nitro file: " + err.Error()})
 		return
 	}
 
 	// Update JSON content
 	log.Printf("[DEBUG] updateNitroJSON: updating JSON content")
-	err = lib.UpdateJSONContent(jsonData)
+	err = lib.UpdateJSONContent(jsonContent)
 	if err != nil {
 		log.Printf("[ERROR] updateNitroJSON: error updating JSON content: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating JSON content: " + err.Error()})
@@ -257,7 +548,7 @@ func updateNitroJSON(c *gin.Context) {
 
 	// Save updated .nitro file
 	log.Printf("[DEBUG] updateNitroJSON: saving updated nitro file")
-	err = lib.Save(nitroPath)
+	revision, err := saveWithRevision(lib, ws, filename, requestAuthor(c), "json")
 	if err != nil {
 		log.Printf("[ERROR] updateNitroJSON: error saving nitro file: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving .nitro file: " + err.Error()})
@@ -265,11 +556,20 @@ func updateNitroJSON(c *gin.Context) {
 	}
 
 	log.Printf("[DEBUG] updateNitroJSON: JSON updated successfully for %s", filename)
-	c.JSON(http.StatusOK, gin.H{"message": "JSON updated successfully"})
+	response := gin.H{"message": "JSON updated successfully"}
+	if revision != nil {
+		response["revision"] = revision.Number
+	}
+	c.JSON(http.StatusOK, response)
 }
 
 // getNitroPNG extracts PNG file from .nitro
 func getNitroPNG(c *gin.Context) {
+	ws := requestWorkspace(c)
+	if ws == nil {
+		return
+	}
+
 	filename := c.Param("filename")
 	if filename == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Filename is required"})
@@ -282,16 +582,15 @@ func getNitroPNG(c *gin.Context) {
 	}
 
 	// Load .nitro file
-	nitroPath := filepath.Join("../uploads", filename)
-	lib, err := LoadNitroLibrary(nitroPath)
+	lib, err := LoadNitroLibrary(ws.Store, filename)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error loading .nitro file: " + err.Error()})
+		c.JSON(nitroErrorStatus(err), gin.H{"error": "Error loading .nitro file: " + err.Error()})
 		return
 	}
 
 	// Search for PNG file in archive
 	var pngData []byte
-	for _, file := range lib.Archive.Files {
+	for _, file := range lib.Archive.Entries() {
 		if strings.HasSuffix(strings.ToLower(file.Name), ".png") {
 			pngData = file.Data
 			break
@@ -310,6 +609,11 @@ func getNitroPNG(c *gin.Context) {
 
 // updateNitroPNG updates PNG file inside .nitro
 func updateNitroPNG(c *gin.Context) {
+	ws := requestWorkspace(c)
+	if ws == nil {
+		return
+	}
+
 	filename := c.Param("filename")
 	if filename == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Filename is required"})
@@ -334,25 +638,26 @@ func updateNitroPNG(c *gin.Context) {
 	log.Printf("[DEBUG] updateNitroPNG: received PNG data of size %d bytes", len(pngData))
 
 	// Load .nitro file
-	nitroPath := filepath.Join("../uploads", filename)
-	lib, err := LoadNitroLibrary(nitroPath)
+	unlock := ws.lockFiles(filename)
+	defer unlock()
+	lib, err := LoadNitroLibrary(ws.Store, filename)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error loading .nitro file: " + err.Error()})
+		c.JSON(nitroErrorStatus(err), gin.H{"error": "Error loading .nitro file: " + err.Error()})
 		return
 	}
 
 	// Search and update PNG file in archive
 	var pngFileName string
 	log.Printf("[DEBUG] updateNitroPNG: searching for PNG file in archive with %d files", len(lib.Archive.Files))
-	for name, file := range lib.Archive.Files {
+	for _, file := range lib.Archive.Entries() {
 		log.Printf("[DEBUG] updateNitroPNG: checking file %s", file.Name)
 		if strings.HasSuffix(strings.ToLower(file.Name), ".png") {
 			pngFileName = file.Name
 			log.Printf("[DEBUG] updateNitroPNG: found PNG file %s, updating with %d bytes", pngFileName, len(pngData))
-			lib.Archive.Files[name] = NitroFile{
+			lib.Archive.SetFile(NitroFile{
 				Name: file.Name,
 				Data: pngData,
-			}
+			})
 			break
 		}
 	}
@@ -364,8 +669,8 @@ func updateNitroPNG(c *gin.Context) {
 	}
 
 	// Guardar el archivo .nitro actualizado
-	log.Printf("[DEBUG] updateNitroPNG: saving updated nitro file to %s", nitroPath)
-	err = lib.Save(nitroPath)
+	log.Printf("[DEBUG] updateNitroPNG: saving updated nitro file %s", filename)
+	revision, err := saveWithRevision(lib, ws, filename, requestAuthor(c), "png")
 	if err != nil {
 		log.Printf("[ERROR] updateNitroPNG: error saving nitro file: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving .nitro file: " + err.Error()})
@@ -373,13 +678,22 @@ func updateNitroPNG(c *gin.Context) {
 	}
 
 	log.Printf("[DEBUG] updateNitroPNG: PNG updated successfully for %s", filename)
-	c.JSON(http.StatusOK, gin.H{"message": "PNG updated successfully"})
+	response := gin.H{"message": "PNG updated successfully"}
+	if revision != nil {
+		response["revision"] = revision.Number
+	}
+	c.JSON(http.StatusOK, response)
 }
 
 
 
 // getNitroPNGOriginal devuelve la imagen PNG original sin modificaciones
 func getNitroPNGOriginal(c *gin.Context) {
+	ws := requestWorkspace(c)
+	if ws == nil {
+		return
+	}
+
 	filename := c.Param("filename")
 	if filename == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Nombre de archivo requerido"})
@@ -392,10 +706,9 @@ func getNitroPNGOriginal(c *gin.Context) {
 	}
 
 	// Cargar la biblioteca Nitro
-	nitroPath := filepath.Join("../uploads", filename)
-	lib, err := LoadNitroLibrary(nitroPath)
+	lib, err := LoadNitroLibrary(ws.Store, filename)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error al cargar la biblioteca Nitro: " + err.Error()})
+		c.JSON(nitroErrorStatus(err), gin.H{"error": "Error al cargar la biblioteca Nitro: " + err.Error()})
 		return
 	}
 
@@ -436,6 +749,11 @@ func getNitroVisualizationBySize(lib *NitroLibrary, size int) *NitroVisualizatio
 
 // getDetailedInfo devuelve información detallada de frames, assets y visualizaciones
 func getDetailedInfo(c *gin.Context) {
+	ws := requestWorkspace(c)
+	if ws == nil {
+		return
+	}
+
 	filename := c.Param("filename")
 	if filename == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Nombre de archivo requerido"})
@@ -448,10 +766,9 @@ func getDetailedInfo(c *gin.Context) {
 	}
 
 	// Cargar la biblioteca Nitro
-	nitroPath := filepath.Join("../uploads", filename)
-	lib, err := LoadNitroLibrary(nitroPath)
+	lib, err := LoadNitroLibrary(ws.Store, filename)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error al cargar la biblioteca Nitro: " + err.Error()})
+		c.JSON(nitroErrorStatus(err), gin.H{"error": "Error al cargar la biblioteca Nitro: " + err.Error()})
 		return
 	}
 
@@ -600,6 +917,11 @@ func getDetailedInfo(c *gin.Context) {
 
 // exportNitroFile exporta el archivo .nitro con las modificaciones aplicadas
 func exportNitroFile(c *gin.Context) {
+	ws := requestWorkspace(c)
+	if ws == nil {
+		return
+	}
+
 	filename := c.Param("filename")
 	if filename == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Nombre de archivo requerido"})
@@ -612,19 +934,19 @@ func exportNitroFile(c *gin.Context) {
 	}
 
 	// Cargar la biblioteca Nitro original
-	nitroPath := filepath.Join("../uploads", filename)
-	lib, err := LoadNitroLibrary(nitroPath)
+	lib, err := LoadNitroLibrary(ws.Store, filename)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error al cargar la biblioteca Nitro: " + err.Error()})
+		c.JSON(nitroErrorStatus(err), gin.H{"error": "Error al cargar la biblioteca Nitro: " + err.Error()})
 		return
 	}
 
 	// Crear un nuevo archivo .nitro con las modificaciones
-	exportedData, err := createModifiedNitroFile(lib, filename)
-	if err != nil {
+	var exported bytes.Buffer
+	if _, err := lib.WriteTo(&exported); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error al crear archivo modificado: " + err.Error()})
 		return
 	}
+	exportedData := exported.Bytes()
 
 	// Configurar headers para descarga
 	baseFilename := strings.TrimSuffix(filename, ".nitro")
@@ -0,0 +1,614 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// JSONFields remembers a decoded JSON object: its keys in document order
+// and the raw value of each. The structs of the furni model keep one, so
+// keys they don't model survive a typed edit, and encoding writes keys in
+// the order they were read and unchanged values exactly as they were read.
+type JSONFields struct {
+	keys []string
+	raw  map[string]json.RawMessage
+}
+
+// Keys returns the keys of the object in document order
+func (f *JSONFields) Keys() []string {
+	return append([]string(nil), f.keys...)
+}
+
+// Has reports whether the object has key
+func (f *JSONFields) Has(key string) bool {
+	_, ok := f.raw[key]
+	return ok
+}
+
+// Extra returns the raw value of key, typically one the struct doesn't model
+func (f *JSONFields) Extra(key string) (json.RawMessage, bool) {
+	value, ok := f.raw[key]
+	return value, ok
+}
+
+// SetExtra sets a key the struct doesn't model, appending it if it is new.
+// Keys the struct models are always written from their field.
+func (f *JSONFields) SetExtra(key string, value json.RawMessage) {
+	if f.raw == nil {
+		f.raw = make(map[string]json.RawMessage)
+	}
+	if _, ok := f.raw[key]; !ok {
+		f.keys = append(f.keys, key)
+	}
+	f.raw[key] = value
+}
+
+// Delete removes key. A modeled field removed this way is only written
+// again, as a new key, once it holds a non-zero value.
+func (f *JSONFields) Delete(key string) {
+	if _, ok := f.raw[key]; !ok {
+		return
+	}
+	delete(f.raw, key)
+	for i, k := range f.keys {
+		if k == key {
+			f.keys = append(f.keys[:i:i], f.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+// RenameKeys renames the keys of the object stored under key, keeping their
+// order. Renaming the keys of a modeled map would otherwise write the
+// renamed keys last. Values that aren't objects are left alone.
+func (f *JSONFields) RenameKeys(key string, rename func(string) string) {
+	raw, ok := f.raw[key]
+	if !ok {
+		return
+	}
+	keys, values, err := readObject(raw)
+	if err != nil {
+		return
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, k := range keys {
+		writeMember(&buf, i == 0, rename(k), values[k])
+	}
+	buf.WriteByte('}')
+	f.raw[key] = buf.Bytes()
+}
+
+// modelType describes how a struct of the model maps to JSON keys
+type modelType struct {
+	names []string // key of each field, "" for fields that aren't encoded
+	index map[string]int
+}
+
+var modelTypes sync.Map // reflect.Type → *modelType
+
+func modelFields(t reflect.Type) *modelType {
+	if cached, ok := modelTypes.Load(t); ok {
+		return cached.(*modelType)
+	}
+	mt := &modelType{names: make([]string, t.NumField()), index: make(map[string]int)}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		mt.names[i] = name
+		mt.index[name] = i
+	}
+	modelTypes.Store(t, mt)
+	return mt
+}
+
+// readObject splits a JSON object into its keys, in order, and raw values.
+// A repeated key keeps its first place and its last value, as in Unmarshal.
+func readObject(data []byte) ([]string, map[string]json.RawMessage, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, nil, err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '{' {
+		return nil, nil, fmt.Errorf("expected a JSON object, got %s", jsonKind(tok))
+	}
+	var keys []string
+	values := make(map[string]json.RawMessage)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		key := tok.(string)
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, nil, err
+		}
+		if _, ok := values[key]; !ok {
+			keys = append(keys, key)
+		}
+		values[key] = value
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, nil, err
+	}
+	return keys, values, nil
+}
+
+// jsonKind names the kind of JSON value a token starts
+func jsonKind(tok json.Token) string {
+	switch tok := tok.(type) {
+	case json.Delim:
+		if tok == '[' {
+			return "an array"
+		}
+	case string:
+		return "a string"
+	case float64, json.Number:
+		return "a number"
+	case bool:
+		return "a boolean"
+	case nil:
+		return "null"
+	}
+	return fmt.Sprintf("%v", tok)
+}
+
+// decodeObject decodes a JSON object into the struct v points to, keeping
+// its keys and raw values in fields
+func decodeObject(data []byte, v interface{}, fields *JSONFields) error {
+	if string(bytes.TrimSpace(data)) == "null" {
+		return nil
+	}
+	keys, values, err := readObject(data)
+	if err != nil {
+		return err
+	}
+	rv := reflect.ValueOf(v).Elem()
+	rv.Set(reflect.Zero(rv.Type()))
+	mt := modelFields(rv.Type())
+	for _, key := range keys {
+		if i, ok := mt.index[key]; ok {
+			if err := json.Unmarshal(values[key], rv.Field(i).Addr().Interface()); err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+		}
+	}
+	*fields = JSONFields{keys: keys, raw: values}
+	return nil
+}
+
+// encodeObject encodes the struct v with the keys it was decoded with first,
+// in their order, then the fields that were set since
+func encodeObject(v interface{}, fields *JSONFields) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	mt := modelFields(rv.Type())
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	first := true
+	for _, key := range fields.keys {
+		raw := fields.raw[key]
+		i, ok := mt.index[key]
+		if !ok {
+			writeMember(&buf, first, key, raw)
+			first = false
+			continue
+		}
+		value, err := encodeValue(rv.Field(i), raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		if value != nil {
+			writeMember(&buf, first, key, value)
+			first = false
+		}
+	}
+	for i, key := range mt.names {
+		if key == "" || fields.Has(key) || rv.Field(i).IsZero() {
+			continue
+		}
+		value, err := encodeValue(rv.Field(i), nil)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		writeMember(&buf, first, key, value)
+		first = false
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// encodeValue encodes a field given the raw value it was decoded from, if
+// any. An unchanged value is written as it was read. A nil returned value
+// means the field was cleared and is left out.
+func encodeValue(v reflect.Value, raw json.RawMessage) ([]byte, error) {
+	if v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String && !v.IsNil() {
+		return encodeMap(v, raw)
+	}
+	data, err := marshalJSON(v.Interface())
+	if err != nil {
+		return nil, err
+	}
+	if raw == nil {
+		return data, nil
+	}
+	if sameJSON(data, raw, v.Type()) {
+		return raw, nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface:
+		if v.IsNil() {
+			return nil, nil
+		}
+	}
+	return data, nil
+}
+
+// encodeMap encodes a map with the keys of raw first, in their order, then
+// the keys added since, sorted
+func encodeMap(v reflect.Value, raw json.RawMessage) ([]byte, error) {
+	var keys []string
+	var values map[string]json.RawMessage
+	if raw != nil {
+		// raw may not be an object, then every key counts as added
+		keys, values, _ = readObject(raw)
+	}
+	order := make([]string, 0, v.Len())
+	for _, key := range keys {
+		if v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key())).IsValid() {
+			order = append(order, key)
+		}
+	}
+	var added []string
+	iter := v.MapRange()
+	for iter.Next() {
+		if _, ok := values[iter.Key().String()]; !ok {
+			added = append(added, iter.Key().String())
+		}
+	}
+	sort.Strings(added)
+	order = append(order, added...)
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range order {
+		value, err := encodeValue(v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key())), values[key])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		if value == nil {
+			value = []byte("null")
+		}
+		writeMember(&buf, i == 0, key, value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// sameJSON reports whether raw decodes to the value data encodes, as numbers
+// and strings can be written several ways
+func sameJSON(data, raw []byte, t reflect.Type) bool {
+	var compact bytes.Buffer
+	if json.Compact(&compact, raw) == nil && bytes.Equal(compact.Bytes(), data) {
+		return true
+	}
+	decoded := reflect.New(t)
+	if json.Unmarshal(raw, decoded.Interface()) != nil {
+		return false
+	}
+	again, err := marshalJSON(decoded.Elem().Interface())
+	return err == nil && bytes.Equal(again, data)
+}
+
+// writeMember writes "key":value to an object being encoded
+func writeMember(buf *bytes.Buffer, first bool, key string, value []byte) {
+	if !first {
+		buf.WriteByte(',')
+	}
+	name, _ := marshalJSON(key)
+	buf.Write(name)
+	buf.WriteByte(':')
+	buf.Write(value)
+}
+
+// marshalJSON is json.Marshal without HTML escaping, which would rewrite
+// strings like "<" that were read unescaped
+func marshalJSON(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// renameKeys returns m with its keys renamed
+func renameKeys[V any](m map[string]V, rename func(string) string) map[string]V {
+	if m == nil {
+		return nil
+	}
+	renamed := make(map[string]V, len(m))
+	for key, value := range m {
+		renamed[rename(key)] = value
+	}
+	return renamed
+}
+
+// The structs of the furni model decode and encode through JSONFields
+
+func (f *NitroFurni) UnmarshalJSON(data []byte) error {
+	return decodeObject(data, f, &f.Fields)
+}
+
+func (f NitroFurni) MarshalJSON() ([]byte, error) {
+	return encodeObject(f, &f.Fields)
+}
+
+func (a *NitroAsset) UnmarshalJSON(data []byte) error {
+	return decodeObject(data, a, &a.Fields)
+}
+
+func (a NitroAsset) MarshalJSON() ([]byte, error) {
+	return encodeObject(a, &a.Fields)
+}
+
+func (a *NitroAlias) UnmarshalJSON(data []byte) error {
+	return decodeObject(data, a, &a.Fields)
+}
+
+func (a NitroAlias) MarshalJSON() ([]byte, error) {
+	return encodeObject(a, &a.Fields)
+}
+
+func (p *NitroPalette) UnmarshalJSON(data []byte) error {
+	return decodeObject(data, p, &p.Fields)
+}
+
+func (p NitroPalette) MarshalJSON() ([]byte, error) {
+	return encodeObject(p, &p.Fields)
+}
+
+func (l *NitroLogic) UnmarshalJSON(data []byte) error {
+	return decodeObject(data, l, &l.Fields)
+}
+
+func (l NitroLogic) MarshalJSON() ([]byte, error) {
+	return encodeObject(l, &l.Fields)
+}
+
+func (m *NitroModel) UnmarshalJSON(data []byte) error {
+	return decodeObject(data, m, &m.Fields)
+}
+
+func (m NitroModel) MarshalJSON() ([]byte, error) {
+	return encodeObject(m, &m.Fields)
+}
+
+func (d *NitroDimensions) UnmarshalJSON(data []byte) error {
+	return decodeObject(data, d, &d.Fields)
+}
+
+func (d NitroDimensions) MarshalJSON() ([]byte, error) {
+	return encodeObject(d, &d.Fields)
+}
+
+func (s *NitroSoundSample) UnmarshalJSON(data []byte) error {
+	return decodeObject(data, s, &s.Fields)
+}
+
+func (s NitroSoundSample) MarshalJSON() ([]byte, error) {
+	return encodeObject(s, &s.Fields)
+}
+
+func (a *NitroAction) UnmarshalJSON(data []byte) error {
+	return decodeObject(data, a, &a.Fields)
+}
+
+func (a NitroAction) MarshalJSON() ([]byte, error) {
+	return encodeObject(a, &a.Fields)
+}
+
+func (p *NitroPlanetSystem) UnmarshalJSON(data []byte) error {
+	return decodeObject(data, p, &p.Fields)
+}
+
+func (p NitroPlanetSystem) MarshalJSON() ([]byte, error) {
+	return encodeObject(p, &p.Fields)
+}
+
+func (p *NitroParticleSystem) UnmarshalJSON(data []byte) error {
+	return decodeObject(data, p, &p.Fields)
+}
+
+func (p NitroParticleSystem) MarshalJSON() ([]byte, error) {
+	return encodeObject(p, &p.Fields)
+}
+
+func (p *NitroParticleEmitter) UnmarshalJSON(data []byte) error {
+	return decodeObject(data, p, &p.Fields)
+}
+
+func (p NitroParticleEmitter) MarshalJSON() ([]byte, error) {
+	return encodeObject(p, &p.Fields)
+}
+
+func (p *NitroParticleSimulation) UnmarshalJSON(data []byte) error {
+	return decodeObject(data, p, &p.Fields)
+}
+
+func (p NitroParticleSimulation) MarshalJSON() ([]byte, error) {
+	return encodeObject(p, &p.Fields)
+}
+
+func (p *NitroParticle) UnmarshalJSON(data []byte) error {
+	return decodeObject(data, p, &p.Fields)
+}
+
+func (p NitroParticle) MarshalJSON() ([]byte, error) {
+	return encodeObject(p, &p.Fields)
+}
+
+func (c *NitroCustomVars) UnmarshalJSON(data []byte) error {
+	return decodeObject(data, c, &c.Fields)
+}
+
+func (c NitroCustomVars) MarshalJSON() ([]byte, error) {
+	return encodeObject(c, &c.Fields)
+}
+
+func (v *NitroVisualization) UnmarshalJSON(data []byte) error {
+	return decodeObject(data, v, &v.Fields)
+}
+
+func (v NitroVisualization) MarshalJSON() ([]byte, error) {
+	return encodeObject(v, &v.Fields)
+}
+
+func (l *NitroLayer) UnmarshalJSON(data []byte) error {
+	return decodeObject(data, l, &l.Fields)
+}
+
+func (l NitroLayer) MarshalJSON() ([]byte, error) {
+	return encodeObject(l, &l.Fields)
+}
+
+func (d *NitroDirection) UnmarshalJSON(data []byte) error {
+	return decodeObject(data, d, &d.Fields)
+}
+
+func (d NitroDirection) MarshalJSON() ([]byte, error) {
+	return encodeObject(d, &d.Fields)
+}
+
+func (c *NitroColor) UnmarshalJSON(data []byte) error {
+	return decodeObject(data, c, &c.Fields)
+}
+
+func (c NitroColor) MarshalJSON() ([]byte, error) {
+	return encodeObject(c, &c.Fields)
+}
+
+func (c *NitroColorLayer) UnmarshalJSON(data []byte) error {
+	return decodeObject(data, c, &c.Fields)
+}
+
+func (c NitroColorLayer) MarshalJSON() ([]byte, error) {
+	return encodeObject(c, &c.Fields)
+}
+
+func (p *NitroPostures) UnmarshalJSON(data []byte) error {
+	return decodeObject(data, p, &p.Fields)
+}
+
+func (p NitroPostures) MarshalJSON() ([]byte, error) {
+	return encodeObject(p, &p.Fields)
+}
+
+func (p *NitroPosture) UnmarshalJSON(data []byte) error {
+	return decodeObject(data, p, &p.Fields)
+}
+
+func (p NitroPosture) MarshalJSON() ([]byte, error) {
+	return encodeObject(p, &p.Fields)
+}
+
+func (g *NitroGesture) UnmarshalJSON(data []byte) error {
+	return decodeObject(data, g, &g.Fields)
+}
+
+func (g NitroGesture) MarshalJSON() ([]byte, error) {
+	return encodeObject(g, &g.Fields)
+}
+
+func (a *NitroAnimation) UnmarshalJSON(data []byte) error {
+	return decodeObject(data, a, &a.Fields)
+}
+
+func (a NitroAnimation) MarshalJSON() ([]byte, error) {
+	return encodeObject(a, &a.Fields)
+}
+
+func (a *NitroAnimationLayer) UnmarshalJSON(data []byte) error {
+	return decodeObject(data, a, &a.Fields)
+}
+
+func (a NitroAnimationLayer) MarshalJSON() ([]byte, error) {
+	return encodeObject(a, &a.Fields)
+}
+
+func (f *NitroFrameSequence) UnmarshalJSON(data []byte) error {
+	return decodeObject(data, f, &f.Fields)
+}
+
+func (f NitroFrameSequence) MarshalJSON() ([]byte, error) {
+	return encodeObject(f, &f.Fields)
+}
+
+func (a *NitroAnimationFrame) UnmarshalJSON(data []byte) error {
+	return decodeObject(data, a, &a.Fields)
+}
+
+func (a NitroAnimationFrame) MarshalJSON() ([]byte, error) {
+	return encodeObject(a, &a.Fields)
+}
+
+func (f *NitroFrameOffset) UnmarshalJSON(data []byte) error {
+	return decodeObject(data, f, &f.Fields)
+}
+
+func (f NitroFrameOffset) MarshalJSON() ([]byte, error) {
+	return encodeObject(f, &f.Fields)
+}
+
+func (s *NitroSpritesheet) UnmarshalJSON(data []byte) error {
+	return decodeObject(data, s, &s.Fields)
+}
+
+func (s NitroSpritesheet) MarshalJSON() ([]byte, error) {
+	return encodeObject(s, &s.Fields)
+}
+
+func (s *NitroSpriteFrame) UnmarshalJSON(data []byte) error {
+	return decodeObject(data, s, &s.Fields)
+}
+
+func (s NitroSpriteFrame) MarshalJSON() ([]byte, error) {
+	return encodeObject(s, &s.Fields)
+}
+
+func (s *NitroSize) UnmarshalJSON(data []byte) error {
+	return decodeObject(data, s, &s.Fields)
+}
+
+func (s NitroSize) MarshalJSON() ([]byte, error) {
+	return encodeObject(s, &s.Fields)
+}
+
+func (p *NitroPivot) UnmarshalJSON(data []byte) error {
+	return decodeObject(data, p, &p.Fields)
+}
+
+func (p NitroPivot) MarshalJSON() ([]byte, error) {
+	return encodeObject(p, &p.Fields)
+}
+
+func (m *NitroMeta) UnmarshalJSON(data []byte) error {
+	return decodeObject(data, m, &m.Fields)
+}
+
+func (m NitroMeta) MarshalJSON() ([]byte, error) {
+	return encodeObject(m, &m.Fields)
+}
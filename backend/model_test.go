@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestModelRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+	}{
+		{"empty", `{}`},
+		{"key order", `{"visualizations":[],"name":"chair","assets":{},"type":"x"}`},
+		{"numbers", `{"assets":{"a":{"y":-0,"x":1.50,"flipH":false}},"logic":{"model":{"dimensions":{"x":1e0,"y":1.0,"z":0.50}}}}`},
+		{"unknown keys", `{"name":"chair","extra":{"b":1,"a":[1,2]},"assets":{"a":{"x":1,"custom":"yes"}},"logic":{"model":{"directions":[2],"more":true}}}`},
+		{"nested unknown keys", `{"visualizations":[{"size":64,"new":1,"layers":{"0":{"ink":"ADD","glow":0.5}},"directions":{"2":{"layers":{"0":{"z":1,"w":2}}}}}]}`},
+		{"strings", `{"name":"café <b>","logic":{"credits":"a\"b\\c"},"x":"\u00e9"}`},
+		{"nulls", `{"aliases":null,"logic":{"soundSample":null,"action":{"link":null}},"unknown":null}`},
+		{"empty containers", `{"assets":{},"aliases":{},"visualizations":[],"logic":{"planetSystems":[],"model":{"directions":[]}}}`},
+		{"palettes", `{"palettes":{"1":{"id":1,"rgb":[[255,0,0],[0,0,0]],"tags":["a"],"master":true}}}`},
+		{"spritesheet", `{"spritesheet":{"meta":{"image":"a.png","size":{"w":4,"h":4},"scale":"1"},"frames":{"b":{"frame":{"x":0,"y":0,"w":4,"h":4},"rotated":false},"a":{"frame":{"x":4,"y":0,"w":1,"h":1}}}}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var furni NitroFurni
+			if err := json.Unmarshal([]byte(tt.json), &furni); err != nil {
+				t.Fatal(err)
+			}
+			data, err := marshalJSON(&furni)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.json {
+				t.Errorf("round trip\n got %s\nwant %s", data, tt.json)
+			}
+		})
+	}
+}
+
+func TestModelEdits(t *testing.T) {
+	const source = `{"name":"chair","extra":1,"assets":{"b":{"x":1.50,"y":2,"custom":true},"a":{"x":0}},"logic":{"model":{"directions":[2,4]}}}`
+	tests := []struct {
+		name string
+		edit func(*NitroFurni)
+		want string
+	}{
+		{"none", func(*NitroFurni) {}, source},
+		{"modeled value", func(f *NitroFurni) {
+			asset := f.Assets["b"]
+			asset.Y = 3
+			f.Assets["b"] = asset
+		}, `{"name":"chair","extra":1,"assets":{"b":{"x":1.50,"y":3,"custom":true},"a":{"x":0}},"logic":{"model":{"directions":[2,4]}}}`},
+		{"added map key", func(f *NitroFurni) {
+			f.Assets["0"] = NitroAsset{Source: "a"}
+		}, `{"name":"chair","extra":1,"assets":{"b":{"x":1.50,"y":2,"custom":true},"a":{"x":0},"0":{"source":"a"}},"logic":{"model":{"directions":[2,4]}}}`},
+		{"removed map key", func(f *NitroFurni) {
+			delete(f.Assets, "b")
+		}, `{"name":"chair","extra":1,"assets":{"a":{"x":0}},"logic":{"model":{"directions":[2,4]}}}`},
+		{"added field", func(f *NitroFurni) {
+			f.LogicType = "furniture_basic"
+			f.Logic.Model.Dimensions.X = 1
+		}, `{"name":"chair","extra":1,"assets":{"b":{"x":1.50,"y":2,"custom":true},"a":{"x":0}},"logic":{"model":{"directions":[2,4],"dimensions":{"x":1}}},"logicType":"furniture_basic"}`},
+		{"cleared field", func(f *NitroFurni) {
+			f.Logic.Model.Directions = nil
+		}, `{"name":"chair","extra":1,"assets":{"b":{"x":1.50,"y":2,"custom":true},"a":{"x":0}},"logic":{"model":{}}}`},
+		{"extra", func(f *NitroFurni) {
+			f.Fields.SetExtra("extra", json.RawMessage(`2`))
+			f.Fields.SetExtra("new", json.RawMessage(`"x"`))
+			f.Fields.Delete("name")
+		}, `{"extra":2,"assets":{"b":{"x":1.50,"y":2,"custom":true},"a":{"x":0}},"logic":{"model":{"directions":[2,4]}},"new":"x","name":"chair"}`},
+		{"renamed keys", func(f *NitroFurni) {
+			rename := func(s string) string { return s + s }
+			f.Assets = renameKeys(f.Assets, rename)
+			f.Fields.RenameKeys("assets", rename)
+		}, `{"name":"chair","extra":1,"assets":{"bb":{"x":1.50,"y":2,"custom":true},"aa":{"x":0}},"logic":{"model":{"directions":[2,4]}}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var furni NitroFurni
+			if err := json.Unmarshal([]byte(source), &furni); err != nil {
+				t.Fatal(err)
+			}
+			tt.edit(&furni)
+			data, err := marshalJSON(&furni)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Errorf("encoded\n got %s\nwant %s", data, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncJSONUnedited(t *testing.T) {
+	lib, err := ParseNitroLibrary(testArchive(t, "chair", aliasedChairJSON, testSheet(4, 4)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lib.SyncJSON(); err != nil {
+		t.Fatal(err)
+	}
+	if string(lib.OriginalJSON) != aliasedChairJSON {
+		t.Errorf("unedited JSON changed:\n%s", lib.OriginalJSON)
+	}
+}
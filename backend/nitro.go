@@ -6,12 +6,15 @@ import (
 	"compress/zlib"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"image"
 	"image/color"
 	"image/png"
 	"io"
-	"os"
+	"math"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
@@ -28,25 +31,137 @@ func max(x, y int) int {
 // NitroArchive represents a .nitro file
 type NitroArchive struct {
 	Files map[string]NitroFile
+	// Order keeps entry names in the order they were read, so writing the
+	// archive back produces the same layout. Entries missing from Order are
+	// appended by name when writing.
+	Order []string
 }
 
 // NitroLibrary representa una librería .nitro con capacidades de edición
 type NitroLibrary struct {
-	Archive     *NitroArchive
-	FilePath    string
-	Furni       *NitroFurni
+	Archive      *NitroArchive
+	Name         string // Store name the library was loaded from
+	Furni        *NitroFurni
 	OriginalJSON []byte // Preservar el JSON original
+	// ReuseCompressed writes unchanged entries with their original
+	// compressed bytes, so load→save without edits is byte-identical.
+	ReuseCompressed bool
+	// CompressionLevel is the zlib level used for entries that are recompressed
+	CompressionLevel int
+
+	// furniJSON is the JSON Furni was decoded from, to tell typed edits apart
+	furniJSON []byte
 }
 
 type NitroFile struct {
 	Name string
 	Data []byte
+
+	// compressed holds the zlib stream the entry was read from and sum the
+	// checksum of Data at that time; both are only set by NitroReader.
+	compressed []byte
+	sum        uint32
+}
+
+// unchanged reports whether Data still matches the bytes it was read with.
+func (f NitroFile) unchanged() bool {
+	return f.compressed != nil && crc32.ChecksumIEEE(f.Data) == f.sum
+}
+
+// SetFile adds or replaces an entry, appending new names to the entry order.
+func (a *NitroArchive) SetFile(file NitroFile) {
+	if a.Files == nil {
+		a.Files = make(map[string]NitroFile)
+	}
+	if _, ok := a.Files[file.Name]; !ok {
+		a.Order = append(a.Order, file.Name)
+	}
+	a.Files[file.Name] = file
+}
+
+// RenameFile renames an entry, keeping its place in the entry order.
+func (a *NitroArchive) RenameFile(oldName, newName string) {
+	file, ok := a.Files[oldName]
+	if !ok || oldName == newName {
+		return
+	}
+	delete(a.Files, newName)
+	delete(a.Files, oldName)
+	file.Name = newName
+	a.Files[newName] = file
+	for i, name := range a.Order {
+		if name == oldName {
+			a.Order[i] = newName
+		} else if name == newName {
+			a.Order[i] = ""
+		}
+	}
+}
+
+// Entries returns the archive entries in their original order followed by
+// any entries added since, sorted by name.
+func (a *NitroArchive) Entries() []NitroFile {
+	entries := make([]NitroFile, 0, len(a.Files))
+	seen := make(map[string]bool, len(a.Files))
+	for _, name := range a.Order {
+		if file, ok := a.Files[name]; ok && !seen[name] {
+			entries = append(entries, file)
+			seen[name] = true
+		}
+	}
+
+	var added []string
+	for name := range a.Files {
+		if !seen[name] {
+			added = append(added, name)
+		}
+	}
+	sort.Strings(added)
+	for _, name := range added {
+		entries = append(entries, a.Files[name])
+	}
+	return entries
 }
 
 type NitroReader struct {
 	r *bufio.Reader
+	// Limits bounds what the reader accepts, see DefaultNitroLimits
+	Limits NitroLimits
+
+	compressedTotal int64
+	sizeTotal       int64
 }
 
+// NitroLimits bounds the size of archives read from untrusted input.
+// A zero value disables that particular limit.
+type NitroLimits struct {
+	MaxEntries           int   // entries per archive
+	MaxEntryCompressed   int64 // compressed bytes per entry
+	MaxEntrySize         int64 // decompressed bytes per entry
+	MaxArchiveCompressed int64 // compressed bytes across all entries
+	MaxArchiveSize       int64 // decompressed bytes across all entries
+}
+
+// DefaultNitroLimits are generous for real furni, which rarely exceed a few MB
+var DefaultNitroLimits = NitroLimits{
+	MaxEntries:           512,
+	MaxEntryCompressed:   32 << 20,
+	MaxEntrySize:         64 << 20,
+	MaxArchiveCompressed: 64 << 20,
+	MaxArchiveSize:       128 << 20,
+}
+
+// Errors returned by NitroReader for archives that are too large or malformed
+var (
+	ErrEntryTooLarge    = errors.New("archive entry exceeds size limit")
+	ErrArchiveTooLarge  = errors.New("archive exceeds size limit")
+	ErrTooManyEntries   = errors.New("archive has too many entries")
+	ErrDuplicateEntry   = errors.New("duplicate archive entry")
+	ErrTruncatedArchive = errors.New("truncated archive")
+	ErrCorruptEntry     = errors.New("corrupt archive entry")
+	ErrInvalidEntryName = errors.New("invalid archive entry name")
+)
+
 // Asset represents a resource within the .nitro file (maintained for compatibility)
 type Asset struct {
 	Name   string
@@ -111,18 +226,30 @@ type Index struct {
 
 // FurniInfo contiene información básica del mueble
 type FurniInfo struct {
-	Name         string   `json:"name"`
-	Directions   []int    `json:"directions"`
-	States       []int    `json:"states"`
-	Colors       []int    `json:"colors"`
-	Size         int      `json:"size"`
-	LayerCount   int      `json:"layer_count"`
-	HasAnimation bool     `json:"has_animation"`
-}
-
-// processNitroFile processes a .nitro file and extracts information
-func processNitroFile(filepath string) (*FurniInfo, error) {
-	archive, err := loadNitroArchive(filepath)
+	Name              string `json:"name"`
+	LogicType         string `json:"logic_type"`
+	VisualizationType string `json:"visualization_type"`
+	Directions        []int  `json:"directions"`
+	States            []int  `json:"states"`
+	Colors            []int  `json:"colors"`
+	Size              int    `json:"size"`
+	Sizes             []int  `json:"sizes"`
+	LayerCount        int    `json:"layer_count"`
+	HasAnimation      bool   `json:"has_animation"`
+}
+
+// processNitroFile processes a stored .nitro file and extracts information
+func processNitroFile(store Store, name string) (*FurniInfo, error) {
+	data, err := store.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return processNitroData(name, data)
+}
+
+// processNitroData extracts information from the contents of a .nitro file
+func processNitroData(name string, data []byte) (*FurniInfo, error) {
+	archive, err := parseNitroArchive(data)
 	if err != nil {
 		return nil, err
 	}
@@ -134,13 +261,26 @@ func processNitroFile(filepath string) (*FurniInfo, error) {
 
 	// If name couldn't be extracted from JSON, use filename
 	if info.Name == "" {
-		info.Name = getFileNameWithoutExt(filepath)
+		info.Name = getFileNameWithoutExt(name)
 	}
 	return info, nil
 }
 
 func NewNitroReader(r io.Reader) *NitroReader {
-	return &NitroReader{r: bufio.NewReader(r)}
+	return &NitroReader{r: bufio.NewReader(r), Limits: DefaultNitroLimits}
+}
+
+// truncated maps the EOF errors of a short read to ErrTruncatedArchive
+func truncated(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrTruncatedArchive
+	}
+	return err
+}
+
+// exceeds reports whether n is over limit, treating a zero limit as unlimited
+func exceeds(n, limit int64) bool {
+	return limit > 0 && n > limit
 }
 
 func (r *NitroReader) readShort() (v uint16, err error) {
@@ -182,6 +322,11 @@ func (r *NitroReader) ReadArchive() (archive NitroArchive, err error) {
 
 	fileCount, err := r.readShort()
 	if err != nil {
+		err = truncated(err)
+		return
+	}
+	if exceeds(int64(fileCount), int64(r.Limits.MaxEntries)) {
+		err = fmt.Errorf("%w: %d entries, limit is %d", ErrTooManyEntries, fileCount, r.Limits.MaxEntries)
 		return
 	}
 
@@ -190,49 +335,219 @@ func (r *NitroReader) ReadArchive() (archive NitroArchive, err error) {
 		if err != nil {
 			return archive, err
 		}
+		if _, ok := archive.Files[file.Name]; ok {
+			return archive, fmt.Errorf("%w: %s", ErrDuplicateEntry, file.Name)
+		}
 		archive.Files[file.Name] = file
+		archive.Order = append(archive.Order, file.Name)
 	}
 
 	return
 }
 
+// ReadFile reads a single entry, enforcing the reader limits before any
+// allocation sized from the input
 func (r *NitroReader) ReadFile() (file NitroFile, err error) {
 	file.Name, err = r.readString()
 	if err != nil {
+		err = truncated(err)
+		return
+	}
+	if file.Name == "" {
+		err = ErrInvalidEntryName
 		return
 	}
 
 	length, err := r.readInt()
 	if err != nil {
+		err = truncated(err)
+		return
+	}
+	if exceeds(int64(length), r.Limits.MaxEntryCompressed) {
+		err = fmt.Errorf("%w: %s is %d bytes compressed", ErrEntryTooLarge, file.Name, length)
+		return
+	}
+	r.compressedTotal += int64(length)
+	if exceeds(r.compressedTotal, r.Limits.MaxArchiveCompressed) {
+		err = fmt.Errorf("%w: more than %d bytes compressed", ErrArchiveTooLarge, r.Limits.MaxArchiveCompressed)
+		return
+	}
+
+	// Keep the compressed bytes so unchanged entries can be written back as-is.
+	// The buffer grows with the bytes that arrive, not with the length the
+	// header claims.
+	var compressedBuf bytes.Buffer
+	if _, err = io.CopyN(&compressedBuf, r.r, int64(length)); err != nil {
+		err = truncated(err)
 		return
 	}
+	compressed := compressedBuf.Bytes()
+
+	// Stop inflating one byte past whichever limit is closer
+	remaining := int64(math.MaxInt64)
+	tooLarge := ErrEntryTooLarge
+	if r.Limits.MaxEntrySize > 0 {
+		remaining = r.Limits.MaxEntrySize
+	}
+	if r.Limits.MaxArchiveSize > 0 && r.Limits.MaxArchiveSize-r.sizeTotal < remaining {
+		remaining = r.Limits.MaxArchiveSize - r.sizeTotal
+		tooLarge = ErrArchiveTooLarge
+	}
 
-	// Use LimitReader to read exactly the compressed data length
-	buffer := bytes.NewBuffer(make([]byte, 0, length*3/2))
-	z, err := zlib.NewReader(io.LimitReader(r.r, int64(length)))
+	z, err := zlib.NewReader(bytes.NewReader(compressed))
 	if err != nil {
+		err = fmt.Errorf("%w: %s: %v", ErrCorruptEntry, file.Name, err)
 		return
 	}
 	defer z.Close()
 
-	_, err = io.Copy(buffer, z)
+	buffer := bytes.NewBuffer(make([]byte, 0, min(int64(length)*3/2, remaining)))
+	n, err := io.Copy(buffer, io.LimitReader(z, remaining+1))
 	if err != nil {
+		err = fmt.Errorf("%w: %s: %v", ErrCorruptEntry, file.Name, err)
 		return
 	}
+	if n > remaining {
+		err = fmt.Errorf("%w: %s inflates past the limit", tooLarge, file.Name)
+		return
+	}
+	r.sizeTotal += n
 
 	file.Data = buffer.Bytes()
+	file.compressed = compressed
+	file.sum = crc32.ChecksumIEEE(file.Data)
 	return
 }
 
-// loadNitroArchive loads a .nitro file
-func loadNitroArchive(filepath string) (*NitroArchive, error) {
-	file, err := os.Open(filepath)
+// NitroWriter writes .nitro archives, mirroring NitroReader
+type NitroWriter struct {
+	w *bufio.Writer
+	// Level is the zlib compression level used for entries
+	Level int
+	// ReuseCompressed writes entries whose data hasn't changed since they were
+	// read with their original compressed bytes
+	ReuseCompressed bool
+}
+
+var (
+	ErrNameTooLong  = errors.New("entry name longer than 65535 bytes")
+	ErrTooManyFiles = errors.New("archive has more than 65535 entries")
+)
+
+func NewNitroWriter(w io.Writer) *NitroWriter {
+	return &NitroWriter{w: bufio.NewWriter(w), Level: zlib.DefaultCompression}
+}
+
+func (w *NitroWriter) writeShort(v uint16) error {
+	var buf [2]byte
+	binary.BigEndian.PutUint16(buf[:], v)
+	_, err := w.w.Write(buf[:])
+	return err
+}
+
+func (w *NitroWriter) writeInt(v uint32) error {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	_, err := w.w.Write(buf[:])
+	return err
+}
+
+func (w *NitroWriter) writeString(s string) error {
+	if len(s) > math.MaxUint16 {
+		return fmt.Errorf("%w: %.32q...", ErrNameTooLong, s)
+	}
+	if err := w.writeShort(uint16(len(s))); err != nil {
+		return err
+	}
+	_, err := w.w.WriteString(s)
+	return err
+}
+
+// WriteArchive writes every entry of the archive in order and flushes the
+// underlying writer. Names and entry count are checked before anything is
+// written, so an invalid archive never produces partial output.
+func (w *NitroWriter) WriteArchive(archive *NitroArchive) error {
+	entries := archive.Entries()
+	if len(entries) > math.MaxUint16 {
+		return fmt.Errorf("%w: %d", ErrTooManyFiles, len(entries))
+	}
+	for _, file := range entries {
+		if len(file.Name) > math.MaxUint16 {
+			return fmt.Errorf("%w: %.32q...", ErrNameTooLong, file.Name)
+		}
+	}
+
+	if err := w.writeShort(uint16(len(entries))); err != nil {
+		return err
+	}
+	for _, file := range entries {
+		if err := w.WriteFile(file); err != nil {
+			return fmt.Errorf("error writing %s: %w", file.Name, err)
+		}
+	}
+	return w.Flush()
+}
+
+// WriteFile writes a single entry. The data is compressed twice, first only
+// to measure the length prefix, so entries are streamed without buffering.
+func (w *NitroWriter) WriteFile(file NitroFile) error {
+	if err := w.writeString(file.Name); err != nil {
+		return err
+	}
+
+	if w.ReuseCompressed && file.unchanged() {
+		if err := w.writeInt(uint32(len(file.compressed))); err != nil {
+			return err
+		}
+		_, err := w.w.Write(file.compressed)
+		return err
+	}
+
+	counter := &countingWriter{w: io.Discard}
+	if err := w.compress(counter, file.Data); err != nil {
+		return err
+	}
+	if counter.n > math.MaxUint32 {
+		return fmt.Errorf("compressed entry is %d bytes, larger than 4 GiB", counter.n)
+	}
+	if err := w.writeInt(uint32(counter.n)); err != nil {
+		return err
+	}
+	return w.compress(w.w, file.Data)
+}
+
+// Flush writes any buffered data to the underlying writer
+func (w *NitroWriter) Flush() error {
+	return w.w.Flush()
+}
+
+func (w *NitroWriter) compress(dst io.Writer, data []byte) error {
+	z, err := zlib.NewWriterLevel(dst, w.Level)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if _, err := z.Write(data); err != nil {
+		z.Close()
+		return err
 	}
-	defer file.Close()
+	return z.Close()
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
 
-	reader := NewNitroReader(file)
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// parseNitroArchive reads a .nitro file from memory
+func parseNitroArchive(data []byte) (*NitroArchive, error) {
+	reader := NewNitroReader(bytes.NewReader(data))
 	archive, err := reader.ReadArchive()
 	if err != nil {
 		return nil, err
@@ -241,101 +556,253 @@ func loadNitroArchive(filepath string) (*NitroArchive, error) {
 	return &archive, nil
 }
 
-// Estructura para el JSON principal del furni (basado en nx)
+// Estructura para el JSON principal del furni (basado en nx). Every object
+// keeps the keys it doesn't model and the order of all its keys in Fields,
+// so a furni edited through these types encodes back without losing anything.
 type NitroFurni struct {
-	Name              string                     `json:"name"`
-	LogicType         string                     `json:"logicType"`
-	VisualizationType string                     `json:"visualizationType"`
-	Assets            map[string]NitroAsset      `json:"assets"`
-	Logic             NitroLogic                 `json:"logic"`
-	Visualizations    []NitroVisualization       `json:"visualizations"`
-	Spritesheet       NitroSpritesheet           `json:"spritesheet"`
+	Type              string                  `json:"type"`
+	Name              string                  `json:"name"`
+	LogicType         string                  `json:"logicType"`
+	VisualizationType string                  `json:"visualizationType"`
+	Assets            map[string]NitroAsset   `json:"assets"`
+	Aliases           map[string]NitroAlias   `json:"aliases"`
+	Palettes          map[string]NitroPalette `json:"palettes"`
+	Logic             NitroLogic              `json:"logic"`
+	Visualizations    []NitroVisualization    `json:"visualizations"`
+	Spritesheet       NitroSpritesheet        `json:"spritesheet"`
+	Fields            JSONFields              `json:"-"`
 }
 
 type NitroAsset struct {
-	Source string  `json:"source"`
-	X      float64 `json:"x"`
-	Y      float64 `json:"y"`
-	FlipH  bool    `json:"flipH"`
-	FlipV  bool    `json:"flipV"`
+	Source      string     `json:"source"`
+	X           float64    `json:"x"`
+	Y           float64    `json:"y"`
+	FlipH       bool       `json:"flipH"`
+	FlipV       bool       `json:"flipV"`
+	UsesPalette bool       `json:"usesPalette"`
+	Fields      JSONFields `json:"-"`
+}
+
+type NitroAlias struct {
+	Link   string     `json:"link"`
+	FlipH  bool       `json:"flipH"`
+	FlipV  bool       `json:"flipV"`
+	Fields JSONFields `json:"-"`
+}
+
+type NitroPalette struct {
+	Id       int        `json:"id"`
+	Source   string     `json:"source"`
+	Master   bool       `json:"master"`
+	Tags     []string   `json:"tags"`
+	Breed    int        `json:"breed"`
+	ColorTag int        `json:"colorTag"`
+	Color1   string     `json:"color1"`
+	Color2   string     `json:"color2"`
+	RGB      [][]int    `json:"rgb"`
+	Fields   JSONFields `json:"-"`
 }
 
 type NitroLogic struct {
 	Model           NitroModel            `json:"model"`
-	ParticleSystems []NitroParticleSystem `json:"particleSystems,omitempty"`
+	MaskType        string                `json:"maskType"`
+	Credits         string                `json:"credits"`
+	SoundSample     *NitroSoundSample     `json:"soundSample"`
+	Action          *NitroAction          `json:"action"`
+	PlanetSystems   []NitroPlanetSystem   `json:"planetSystems"`
+	ParticleSystems []NitroParticleSystem `json:"particleSystems"`
+	CustomVars      *NitroCustomVars      `json:"customVars"`
+	Fields          JSONFields            `json:"-"`
 }
 
 type NitroModel struct {
 	Dimensions NitroDimensions `json:"dimensions"`
 	Directions []int           `json:"directions"`
+	Fields     JSONFields      `json:"-"`
 }
 
 type NitroDimensions struct {
-	X float64 `json:"x"`
-	Y float64 `json:"y"`
-	Z float64 `json:"z"`
+	X       float64    `json:"x"`
+	Y       float64    `json:"y"`
+	Z       float64    `json:"z"`
+	CenterZ float64    `json:"centerZ"`
+	Fields  JSONFields `json:"-"`
+}
+
+type NitroSoundSample struct {
+	Id      int        `json:"id"`
+	NoPitch bool       `json:"noPitch"`
+	Fields  JSONFields `json:"-"`
+}
+
+type NitroAction struct {
+	Link       string     `json:"link"`
+	StartState int        `json:"startState"`
+	Fields     JSONFields `json:"-"`
+}
+
+type NitroPlanetSystem struct {
+	Id        int        `json:"id"`
+	Name      string     `json:"name"`
+	Parent    string     `json:"parent"`
+	Radius    float64    `json:"radius"`
+	ArcSpeed  float64    `json:"arcSpeed"`
+	ArcOffset float64    `json:"arcOffset"`
+	Blend     float64    `json:"blend"`
+	Height    float64    `json:"height"`
+	Fields    JSONFields `json:"-"`
 }
 
 type NitroParticleSystem struct {
-	Size int `json:"size"`
+	Size     int                    `json:"size"`
+	CanvasId int                    `json:"canvasId"`
+	OffsetY  float64                `json:"offsetY"`
+	Blend    float64                `json:"blend"`
+	BgColor  string                 `json:"bgColor"`
+	Emitters []NitroParticleEmitter `json:"emitters"`
+	Fields   JSONFields             `json:"-"`
+}
+
+type NitroParticleEmitter struct {
+	Id                int                     `json:"id"`
+	Name              string                  `json:"name"`
+	SpriteId          int                     `json:"spriteId"`
+	MaxNumParticles   int                     `json:"maxNumParticles"`
+	ParticlesPerFrame int                     `json:"particlesPerFrame"`
+	BurstPulse        int                     `json:"burstPulse"`
+	FuseTime          int                     `json:"fuseTime"`
+	Simulation        NitroParticleSimulation `json:"simulation"`
+	Particles         []NitroParticle         `json:"particles"`
+	Fields            JSONFields              `json:"-"`
+}
+
+type NitroParticleSimulation struct {
+	Force       float64    `json:"force"`
+	Direction   float64    `json:"direction"`
+	Gravity     float64    `json:"gravity"`
+	AirFriction float64    `json:"airFriction"`
+	Shape       string     `json:"shape"`
+	Energy      float64    `json:"energy"`
+	Fields      JSONFields `json:"-"`
+}
+
+type NitroParticle struct {
+	IsEmitter bool       `json:"isEmitter"`
+	LifeTime  int        `json:"lifeTime"`
+	Fade      bool       `json:"fade"`
+	Frames    []string   `json:"frames"`
+	Fields    JSONFields `json:"-"`
+}
+
+type NitroCustomVars struct {
+	Variables []string   `json:"variables"`
+	Fields    JSONFields `json:"-"`
 }
 
 type NitroVisualization struct {
-	Angle      int                           `json:"angle"`
-	LayerCount int                           `json:"layerCount"`
-	Size       int                           `json:"size"`
-	Layers     map[string]NitroLayer         `json:"layers"`
-	Directions map[string]NitroDirection     `json:"directions"`
-	Colors     map[string]NitroColor         `json:"colors"`
-	Animations map[string]NitroAnimation     `json:"animations"`
+	Angle      int                       `json:"angle"`
+	LayerCount int                       `json:"layerCount"`
+	Size       int                       `json:"size"`
+	Layers     map[string]NitroLayer     `json:"layers"`
+	Directions map[string]NitroDirection `json:"directions"`
+	Colors     map[string]NitroColor     `json:"colors"`
+	Animations map[string]NitroAnimation `json:"animations"`
+	Postures   *NitroPostures            `json:"postures"`
+	Gestures   []NitroGesture            `json:"gestures"`
+	Fields     JSONFields                `json:"-"`
 }
 
 type NitroLayer struct {
-	Z           float64 `json:"z"`
-	Alpha       int     `json:"alpha"`
-	Ink         string  `json:"ink"`
-	IgnoreMouse bool    `json:"ignoreMouse"`
-	Color       int     `json:"color"`
-	X           float64 `json:"x,omitempty"`
-	Y           float64 `json:"y,omitempty"`
+	Z           float64    `json:"z"`
+	Alpha       int        `json:"alpha"`
+	Ink         string     `json:"ink"`
+	Tag         string     `json:"tag"`
+	IgnoreMouse bool       `json:"ignoreMouse"`
+	Color       int        `json:"color"`
+	X           float64    `json:"x"`
+	Y           float64    `json:"y"`
+	Fields      JSONFields `json:"-"`
 }
 
 type NitroDirection struct {
-	Id     int                    `json:"id"`
-	Layers map[string]NitroLayer `json:"layers,omitempty"`
+	Id     int                   `json:"id"`
+	Layers map[string]NitroLayer `json:"layers"`
+	Fields JSONFields            `json:"-"`
 }
 
 type NitroColor struct {
 	Layers map[string]NitroColorLayer `json:"layers"`
+	Fields JSONFields                 `json:"-"`
 }
 
 type NitroColorLayer struct {
-	Color string `json:"color"`
+	Color  string     `json:"color"`
+	Fields JSONFields `json:"-"`
+}
+
+type NitroPostures struct {
+	DefaultPosture string         `json:"defaultPosture"`
+	Postures       []NitroPosture `json:"postures"`
+	Fields         JSONFields     `json:"-"`
+}
+
+type NitroPosture struct {
+	Id          string     `json:"id"`
+	AnimationId int        `json:"animationId"`
+	Fields      JSONFields `json:"-"`
+}
+
+type NitroGesture struct {
+	Id          string     `json:"id"`
+	AnimationId int        `json:"animationId"`
+	Fields      JSONFields `json:"-"`
 }
 
 type NitroAnimation struct {
-	Layers       map[string]NitroAnimationLayer `json:"layers"`
-	TransitionTo *int                          `json:"transitionTo,omitempty"`
+	Layers              map[string]NitroAnimationLayer `json:"layers"`
+	TransitionTo        *int                           `json:"transitionTo"`
+	TransitionFrom      *int                           `json:"transitionFrom"`
+	ImmediateChangeFrom string                         `json:"immediateChangeFrom"`
+	RandomStart         bool                           `json:"randomStart"`
+	Fields              JSONFields                     `json:"-"`
 }
 
 type NitroAnimationLayer struct {
-	LoopCount      float64                           `json:"loopCount"`
-	FrameRepeat    float64                           `json:"frameRepeat"`
-	Random         float64                           `json:"random"`
-	FrameSequences map[string]NitroFrameSequence     `json:"frameSequences"`
+	LoopCount      float64                       `json:"loopCount"`
+	FrameRepeat    float64                       `json:"frameRepeat"`
+	Random         float64                       `json:"random"`
+	FrameSequences map[string]NitroFrameSequence `json:"frameSequences"`
+	Fields         JSONFields                    `json:"-"`
 }
 
 type NitroFrameSequence struct {
-	Frames map[string]NitroAnimationFrame `json:"frames"`
+	LoopCount float64                        `json:"loopCount"`
+	Random    float64                        `json:"random"`
+	Frames    map[string]NitroAnimationFrame `json:"frames"`
+	Fields    JSONFields                     `json:"-"`
 }
 
 type NitroAnimationFrame struct {
-	Id int `json:"id"`
+	Id      int                         `json:"id"`
+	X       float64                     `json:"x"`
+	Y       float64                     `json:"y"`
+	RandomX float64                     `json:"randomX"`
+	RandomY float64                     `json:"randomY"`
+	Offsets map[string]NitroFrameOffset `json:"offsets"`
+	Fields  JSONFields                  `json:"-"`
+}
+
+type NitroFrameOffset struct {
+	Direction int        `json:"direction"`
+	X         float64    `json:"x"`
+	Y         float64    `json:"y"`
+	Fields    JSONFields `json:"-"`
 }
 
 type NitroSpritesheet struct {
 	Frames map[string]NitroSpriteFrame `json:"frames"`
 	Meta   NitroMeta                   `json:"meta"`
+	Fields JSONFields                  `json:"-"`
 }
 
 type NitroSpriteFrame struct {
@@ -345,22 +812,44 @@ type NitroSpriteFrame struct {
 	SpriteSourceSize NitroSize  `json:"spriteSourceSize"`
 	SourceSize       NitroSize  `json:"sourceSize"`
 	Pivot            NitroPivot `json:"pivot"`
+	Fields           JSONFields `json:"-"`
 }
 
 type NitroSize struct {
-	X int `json:"x"`
-	Y int `json:"y"`
-	W int `json:"w"`
-	H int `json:"h"`
+	X      int        `json:"x"`
+	Y      int        `json:"y"`
+	W      int        `json:"w"`
+	H      int        `json:"h"`
+	Fields JSONFields `json:"-"`
 }
 
 type NitroPivot struct {
-	X float64 `json:"x"`
-	Y float64 `json:"y"`
+	X      float64    `json:"x"`
+	Y      float64    `json:"y"`
+	Fields JSONFields `json:"-"`
 }
 
 type NitroMeta struct {
-	Image string `json:"image"`
+	App     string     `json:"app"`
+	Version string     `json:"version"`
+	Image   string     `json:"image"`
+	Format  string     `json:"format"`
+	Size    NitroSize  `json:"size"`
+	Fields  JSONFields `json:"-"`
+}
+
+// findNitroFurni returns the main furni JSON of an archive, or nil
+func findNitroFurni(archive *NitroArchive) *NitroFurni {
+	for _, file := range archive.Entries() {
+		if !strings.HasSuffix(file.Name, ".json") {
+			continue
+		}
+		var furniData *NitroFurni
+		if err := json.Unmarshal(file.Data, &furniData); err == nil && furniData != nil && furniData.Name != "" {
+			return furniData
+		}
+	}
+	return nil
 }
 
 // Helper function to process archive files
@@ -369,33 +858,25 @@ func processNitroArchive(archive *NitroArchive) (*FurniInfo, error) {
 		Directions: []int{},
 		States:     []int{},
 		Colors:     []int{},
+		Sizes:      []int{},
 	}
 
 
 
 	// Search for main furni JSON file
-	var furniData *NitroFurni
-	for name, file := range archive.Files {
-
-		if strings.HasSuffix(name, ".json") {
-
-			err := json.Unmarshal(file.Data, &furniData)
-			if err == nil && furniData.Name != "" {
-				info.Name = furniData.Name
-
-				break
-			}
-		}
-	}
-
+	furniData := findNitroFurni(archive)
 	if furniData == nil {
 		return info, nil
 	}
+	info.Name = furniData.Name
+	info.LogicType = furniData.LogicType
+	info.VisualizationType = furniData.VisualizationType
 
 	// Extraer información de las visualizaciones
 	maxSize := 0
 	for _, vis := range furniData.Visualizations {
 		fmt.Printf("[DEBUG] Processing visualization with size: %d\n", vis.Size)
+		info.Sizes = append(info.Sizes, vis.Size)
 
 		// Usar la visualización más grande para obtener información básica
 		if vis.Size > maxSize {
@@ -449,6 +930,7 @@ func processNitroArchive(archive *NitroArchive) (*FurniInfo, error) {
 	sort.Ints(info.Directions)
 	sort.Ints(info.States)
 	sort.Ints(info.Colors)
+	sort.Ints(info.Sizes)
 
 	// If no states, add default state
 	if len(info.States) == 0 {
@@ -482,9 +964,24 @@ func getFileNameWithoutExt(filepath string) string {
 
 
 
-// LoadNitroLibrary loads a .nitro file and returns a NitroLibrary
-func LoadNitroLibrary(filepath string) (*NitroLibrary, error) {
-	archive, err := loadNitroArchive(filepath)
+// LoadNitroLibrary loads a stored .nitro file and returns a NitroLibrary
+func LoadNitroLibrary(store Store, name string) (*NitroLibrary, error) {
+	data, err := store.Get(name)
+	if err != nil {
+		return nil, err
+	}
+
+	lib, err := ParseNitroLibrary(data)
+	if err != nil {
+		return nil, err
+	}
+	lib.Name = name
+	return lib, nil
+}
+
+// ParseNitroLibrary reads a NitroLibrary from the contents of a .nitro file
+func ParseNitroLibrary(data []byte) (*NitroLibrary, error) {
+	archive, err := parseNitroArchive(data)
 	if err != nil {
 		return nil, err
 	}
@@ -492,7 +989,7 @@ func LoadNitroLibrary(filepath string) (*NitroLibrary, error) {
 	// Search for JSON file
 	var furni *NitroFurni
 	var originalJSON []byte
-	for _, file := range archive.Files {
+	for _, file := range archive.Entries() {
 		if strings.HasSuffix(file.Name, ".json") {
 			originalJSON = file.Data // Preservar el JSON original
 			err := json.Unmarshal(file.Data, &furni)
@@ -508,10 +1005,12 @@ func LoadNitroLibrary(filepath string) (*NitroLibrary, error) {
 	}
 
 	return &NitroLibrary{
-		Archive:      archive,
-		FilePath:     filepath,
-		Furni:        furni,
-		OriginalJSON: originalJSON,
+		Archive:          archive,
+		Furni:            furni,
+		OriginalJSON:     originalJSON,
+		ReuseCompressed:  true,
+		CompressionLevel: zlib.DefaultCompression,
+		furniJSON:        originalJSON,
 	}, nil
 }
 
@@ -536,114 +1035,142 @@ func (lib *NitroLibrary) GetJSONContent() (string, error) {
 	return string(jsonBytes), nil
 }
 
-// UpdateJSONContent updates JSON content
-func (lib *NitroLibrary) UpdateJSONContent(jsonData map[string]interface{}) error {
-	// Convertir el map a JSON y luego deserializar en la estructura
-	jsonBytes, err := json.Marshal(jsonData)
-	if err != nil {
-		return fmt.Errorf("error serializing JSON data: %v", err)
-	}
-
+// UpdateJSONContent replaces the furni JSON with data, which is kept as it
+// was written: key order, formatting and keys the model doesn't know
+func (lib *NitroLibrary) UpdateJSONContent(data []byte) error {
 	var newFurni NitroFurni
-	err = json.Unmarshal(jsonBytes, &newFurni)
+	err := json.Unmarshal(data, &newFurni)
 	if err != nil {
 		return fmt.Errorf("error deserializing JSON: %v", err)
 	}
 
 	lib.Furni = &newFurni
-	// Also update original JSON with new content
-	lib.OriginalJSON = jsonBytes
+	lib.OriginalJSON = data
+	lib.furniJSON = data
 	return nil
 }
 
-// Save saves updated .nitro file
-func (lib *NitroLibrary) Save(filepath string) error {
-	// Usar el JSON original actualizado si está disponible
-	var jsonBytes []byte
-	if lib.OriginalJSON != nil {
-		jsonBytes = lib.OriginalJSON
-	} else {
-		// Fallback: serializar la estructura
-		var err error
-		jsonBytes, err = json.Marshal(lib.Furni)
-		if err != nil {
-			return fmt.Errorf("error serializing JSON: %v", err)
-		}
+// SyncJSON writes typed edits made to Furni into OriginalJSON. OriginalJSON
+// stays as it is while Furni still matches the JSON it was decoded from, so
+// saving a library that wasn't edited keeps its JSON byte for byte.
+func (lib *NitroLibrary) SyncJSON() error {
+	if lib.Furni == nil {
+		return nil
 	}
-
-	// Update JSON file in archive
-	for name, file := range lib.Archive.Files {
-		if strings.HasSuffix(file.Name, ".json") {
-			lib.Archive.Files[name] = NitroFile{
-				Name: file.Name,
-				Data: jsonBytes,
+	jsonBytes, err := marshalJSON(lib.Furni)
+	if err != nil {
+		return fmt.Errorf("error serializing JSON: %v", err)
+	}
+	source := lib.furniJSON
+	if source == nil {
+		source = lib.OriginalJSON
+	}
+	if source != nil {
+		var decoded NitroFurni
+		if json.Unmarshal(source, &decoded) == nil {
+			if unedited, err := marshalJSON(&decoded); err == nil && bytes.Equal(unedited, jsonBytes) {
+				return nil
 			}
-			break
 		}
 	}
-
-	// Write updated .nitro file
-	return lib.writeNitroArchive(filepath)
+	lib.OriginalJSON = jsonBytes
+	lib.furniJSON = jsonBytes
+	return nil
 }
 
-// writeNitroArchive writes a NitroArchive to a file
-func (lib *NitroLibrary) writeNitroArchive(filepath string) error {
-	file, err := os.Create(filepath)
-	if err != nil {
-		return err
+// Rename changes the furni name everywhere it appears: the name field,
+// spritesheet frame and asset names prefixed with it, meta.image and the
+// archive entries named after it, e.g. chair.json and chair.png
+func (lib *NitroLibrary) Rename(newName string) error {
+	furni := lib.Furni
+	oldName := furni.Name
+	if oldName == "" {
+		return fmt.Errorf("furni has no name to rename")
+	}
+	rename := func(s string) string {
+		return renamePrefixed(s, oldName, newName)
 	}
-	defer file.Close()
 
-	// Write number of files (use BigEndian for consistency with reading)
-	fileCount := uint16(len(lib.Archive.Files))
-	err = binary.Write(file, binary.BigEndian, fileCount)
-	if err != nil {
-		return err
+	furni.Name = newName
+	furni.Spritesheet.Frames = renameKeys(furni.Spritesheet.Frames, rename)
+	furni.Spritesheet.Fields.RenameKeys("frames", rename)
+	furni.Assets = renameKeys(furni.Assets, rename)
+	furni.Fields.RenameKeys("assets", rename)
+	for name, asset := range furni.Assets {
+		asset.Source = rename(asset.Source)
+		furni.Assets[name] = asset
+	}
+	furni.Aliases = renameKeys(furni.Aliases, rename)
+	furni.Fields.RenameKeys("aliases", rename)
+	for name, alias := range furni.Aliases {
+		alias.Link = rename(alias.Link)
+		furni.Aliases[name] = alias
 	}
 
-	// Write each file
-	for _, nitroFile := range lib.Archive.Files {
-		// Write name length
-		nameLen := uint16(len(nitroFile.Name))
-		err = binary.Write(file, binary.BigEndian, nameLen)
-		if err != nil {
-			return err
+	// Entries named after the furni follow the new name
+	for _, file := range lib.Archive.Entries() {
+		ext := filepath.Ext(file.Name)
+		if strings.TrimSuffix(file.Name, ext) == oldName {
+			lib.Archive.RenameFile(file.Name, newName+ext)
 		}
+	}
+	image := furni.Spritesheet.Meta.Image
+	if ext := filepath.Ext(image); strings.TrimSuffix(image, ext) == oldName {
+		furni.Spritesheet.Meta.Image = newName + ext
+	}
 
-		// Escribir nombre
-		_, err = file.WriteString(nitroFile.Name)
-		if err != nil {
-			return err
-		}
+	return lib.SyncJSON()
+}
 
-		// Compress data
-		var compressedData bytes.Buffer
-		zlibWriter := zlib.NewWriter(&compressedData)
-		_, err = zlibWriter.Write(nitroFile.Data)
-		if err != nil {
-			zlibWriter.Close()
-			return err
-		}
-		zlibWriter.Close()
+// renamePrefixed replaces the oldName_ prefix of s with newName_
+func renamePrefixed(s, oldName, newName string) string {
+	if strings.HasPrefix(s, oldName+"_") {
+		return newName + strings.TrimPrefix(s, oldName)
+	}
+	return s
+}
 
-		// Write compressed data length
-		compressedLen := uint32(compressedData.Len())
-		err = binary.Write(file, binary.BigEndian, compressedLen)
-		if err != nil {
-			return err
-		}
+// Save saves updated .nitro file to the store under name
+func (lib *NitroLibrary) Save(store Store, name string) error {
+	// Usar el JSON original, con los cambios hechos a Furni
+	if err := lib.SyncJSON(); err != nil {
+		return err
+	}
+	jsonBytes := lib.OriginalJSON
 
-		// Escribir datos comprimidos
-		_, err = file.Write(compressedData.Bytes())
-		if err != nil {
-			return err
+	// Update JSON file in archive, leaving it untouched if nothing changed
+	for _, file := range lib.Archive.Entries() {
+		if strings.HasSuffix(file.Name, ".json") {
+			if !bytes.Equal(file.Data, jsonBytes) {
+				lib.Archive.SetFile(NitroFile{
+					Name: file.Name,
+					Data: jsonBytes,
+				})
+			}
+			break
 		}
 	}
 
-	return nil
+	// Write updated .nitro file
+	var buf bytes.Buffer
+	if _, err := lib.WriteTo(&buf); err != nil {
+		return err
+	}
+	return store.Put(name, buf.Bytes())
 }
 
+// WriteTo writes the library archive in .nitro format to w
+func (lib *NitroLibrary) WriteTo(w io.Writer) (int64, error) {
+	counter := &countingWriter{w: w}
+	writer := NewNitroWriter(counter)
+	writer.Level = lib.CompressionLevel
+	writer.ReuseCompressed = lib.ReuseCompressed
+	err := writer.WriteArchive(lib.Archive)
+	return counter.n, err
+}
 
+// maxSpritesheetPixels is the largest spritesheet getOriginalPNG decodes
+const maxSpritesheetPixels = 4096 * 4096
 
 // getOriginalPNG obtiene la imagen PNG original del spritesheet
 func getOriginalPNG(lib *NitroLibrary) (image.Image, error) {
@@ -654,6 +1181,15 @@ func getOriginalPNG(lib *NitroLibrary) (image.Image, error) {
 	// Search for PNG file in archive
 	for fileName, file := range lib.Archive.Files {
 		if fileName == lib.Furni.Spritesheet.Meta.Image {
+			// The header decides how much memory decoding takes, so it's
+			// checked first
+			config, err := png.DecodeConfig(bytes.NewReader(file.Data))
+			if err != nil {
+				return nil, fmt.Errorf("error decoding PNG: %v", err)
+			}
+			if int64(config.Width)*int64(config.Height) > maxSpritesheetPixels {
+				return nil, fmt.Errorf("PNG of %dx%d is too large to decode", config.Width, config.Height)
+			}
 			// Decodificar la imagen PNG
 			img, err := png.Decode(bytes.NewReader(file.Data))
 			if err != nil {
@@ -1026,57 +1562,3 @@ func drawDetailedLegend(img *image.RGBA, width, startY int, frameNames, assetNam
 		drawText(img, 10, currentY, "Nitro Viewer - Habbo .nitro file analysis", color.RGBA{100, 100, 100, 255})
 	}
 }
-
-// createModifiedNitroFile creates a new .nitro file with applied modifications
-func createModifiedNitroFile(lib *NitroLibrary, filename string) ([]byte, error) {
-	// The .nitro file already contains all saved modifications
-	// We only need to recreate the file from current library
-	return createNitroArchive(lib.Archive)
-}
-
-// createNitroArchive creates a .nitro file from a NitroArchive
-func createNitroArchive(archive *NitroArchive) ([]byte, error) {
-	var buffer bytes.Buffer
-
-	// Write number of files (using BigEndian for consistency with reading)
-	fileCount := uint16(len(archive.Files))
-	if err := binary.Write(&buffer, binary.BigEndian, fileCount); err != nil {
-		return nil, fmt.Errorf("error writing file count: %v", err)
-	}
-
-	// Write each file
-	for _, file := range archive.Files {
-		// Write name length
-		nameLength := uint16(len(file.Name))
-		if err := binary.Write(&buffer, binary.BigEndian, nameLength); err != nil {
-			return nil, fmt.Errorf("error writing name length: %v", err)
-		}
-
-		// Write filename
-		if _, err := buffer.WriteString(file.Name); err != nil {
-			return nil, fmt.Errorf("error writing filename: %v", err)
-		}
-
-		// Comprimir datos
-		var compressedData bytes.Buffer
-		zlibWriter := zlib.NewWriter(&compressedData)
-		if _, err := zlibWriter.Write(file.Data); err != nil {
-			zlibWriter.Close()
-			return nil, fmt.Errorf("error compressing data: %v", err)
-		}
-		zlibWriter.Close()
-
-		// Escribir longitud de datos comprimidos
-		compressedLength := uint32(compressedData.Len())
-		if err := binary.Write(&buffer, binary.BigEndian, compressedLength); err != nil {
-			return nil, fmt.Errorf("error writing data length: %v", err)
-		}
-
-		// Write compressed data
-		if _, err := buffer.Write(compressedData.Bytes()); err != nil {
-			return nil, fmt.Errorf("error writing file data: %v", err)
-		}
-	}
-
-	return buffer.Bytes(), nil
-}
\ No newline at end of file
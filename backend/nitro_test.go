@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"runtime"
+	"testing"
+)
+
+// testArchive packs a furni JSON and a spritesheet into a .nitro file
+func testArchive(t *testing.T, name, furniJSON string, sheet image.Image) []byte {
+	t.Helper()
+	var pngData bytes.Buffer
+	if err := png.Encode(&pngData, sheet); err != nil {
+		t.Fatal(err)
+	}
+	archive := &NitroArchive{}
+	archive.SetFile(NitroFile{Name: name + ".json", Data: []byte(furniJSON)})
+	archive.SetFile(NitroFile{Name: name + ".png", Data: pngData.Bytes()})
+	var buf bytes.Buffer
+	if err := NewNitroWriter(&buf).WriteArchive(archive); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testSheet is a spritesheet of one opaque w x h frame
+func testSheet(w, h int) image.Image {
+	sheet := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			sheet.SetNRGBA(x, y, color.NRGBA{200, 100, 50, 255})
+		}
+	}
+	return sheet
+}
+
+const aliasedChairJSON = `{
+  "name": "chair",
+  "logicType": "furniture_basic",
+  "visualizationType": "furniture_static",
+  "logic": {"model": {"directions": [2]}},
+  "assets": {
+    "chair_64_a_2_0": {"x": 2, "y": 2}
+  },
+  "aliases": {
+    "chair_64_a_0_0": {"link": "chair_64_a_2_0", "flipH": true}
+  },
+  "visualizations": [{"size": 64, "layerCount": 1, "directions": {"2": {}}}],
+  "spritesheet": {
+    "frames": {"chair_64_a_2_0": {"frame": {"x": 0, "y": 0, "w": 4, "h": 4}}},
+    "meta": {"image": "chair.png"}
+  }
+}`
+
+func TestRenameAliases(t *testing.T) {
+	lib, err := ParseNitroLibrary(testArchive(t, "chair", aliasedChairJSON, testSheet(4, 4)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report := LintLibrary(lib); len(report.Issues) != 0 {
+		t.Fatalf("before rename: %+v", report.Issues)
+	}
+	if err := lib.Rename("stool"); err != nil {
+		t.Fatal(err)
+	}
+
+	alias, ok := lib.Furni.Aliases["stool_64_a_0_0"]
+	if !ok || alias.Link != "stool_64_a_2_0" || !alias.FlipH {
+		t.Errorf("aliases = %+v", lib.Furni.Aliases)
+	}
+	if report := LintLibrary(lib); len(report.Issues) != 0 {
+		t.Errorf("after rename: %+v", report.Issues)
+	}
+
+	// The renamed JSON says the same when read back
+	var reread NitroLibrary
+	reread.Archive = lib.Archive
+	if err := reread.UpdateJSONContent(lib.OriginalJSON); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reread.Furni.Aliases["stool_64_a_0_0"]; !ok || bytes.Contains(lib.OriginalJSON, []byte("chair")) {
+		t.Errorf("renamed JSON:\n%s", lib.OriginalJSON)
+	}
+	if report := LintLibrary(&reread); len(report.Issues) != 0 {
+		t.Errorf("renamed JSON: %+v", report.Issues)
+	}
+}
+
+// testEntries packs files, in order, into a .nitro file
+func testEntries(t *testing.T, files ...NitroFile) []byte {
+	t.Helper()
+	archive := &NitroArchive{}
+	for _, file := range files {
+		archive.SetFile(file)
+	}
+	var buf bytes.Buffer
+	if err := NewNitroWriter(&buf).WriteArchive(archive); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestNitroReaderLimits(t *testing.T) {
+	kb := bytes.Repeat([]byte("a"), 1000)
+	one := testEntries(t, NitroFile{Name: "a", Data: kb})
+	two := testEntries(t, NitroFile{Name: "a", Data: kb}, NitroFile{Name: "b", Data: kb})
+	compressedLen := int64(len(one) - 2 - 3 - 4)
+
+	tests := []struct {
+		name   string
+		data   []byte
+		limits func(*NitroLimits)
+		want   error
+	}{
+		{"empty", nil, nil, ErrTruncatedArchive},
+		{"no entries", []byte{0, 1}, nil, ErrTruncatedArchive},
+		{"short name", []byte{0, 1, 0, 4, 'a'}, nil, ErrTruncatedArchive},
+		{"no length", []byte{0, 1, 0, 1, 'a', 0, 0}, nil, ErrTruncatedArchive},
+		{"short data", one[:len(one)-1], nil, ErrTruncatedArchive},
+		{"missing entry", append([]byte{0, 2}, one[2:]...), nil, ErrTruncatedArchive},
+		{"empty name", []byte{0, 1, 0, 0}, nil, ErrInvalidEntryName},
+		{"not zlib", []byte{0, 1, 0, 1, 'a', 0, 0, 0, 2, 1, 2}, nil, ErrCorruptEntry},
+		{"duplicate", append([]byte{0, 2}, append(one[2:], one[2:]...)...), nil, ErrDuplicateEntry},
+		{"entries", two, func(l *NitroLimits) { l.MaxEntries = 1 }, ErrTooManyEntries},
+		{"entries at limit", two, func(l *NitroLimits) { l.MaxEntries = 2 }, nil},
+		{"entry compressed", one, func(l *NitroLimits) { l.MaxEntryCompressed = compressedLen - 1 }, ErrEntryTooLarge},
+		{"entry compressed at limit", one, func(l *NitroLimits) { l.MaxEntryCompressed = compressedLen }, nil},
+		{"archive compressed", two, func(l *NitroLimits) { l.MaxArchiveCompressed = 2*compressedLen - 1 }, ErrArchiveTooLarge},
+		{"entry size", one, func(l *NitroLimits) { l.MaxEntrySize = 999 }, ErrEntryTooLarge},
+		{"entry size at limit", one, func(l *NitroLimits) { l.MaxEntrySize = 1000 }, nil},
+		{"archive size", two, func(l *NitroLimits) { l.MaxArchiveSize = 1999 }, ErrArchiveTooLarge},
+		{"archive size at limit", two, func(l *NitroLimits) { l.MaxArchiveSize = 2000 }, nil},
+		{"unlimited", two, func(l *NitroLimits) { *l = NitroLimits{} }, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := NewNitroReader(bytes.NewReader(tt.data))
+			if tt.limits != nil {
+				tt.limits(&reader.Limits)
+			}
+			_, err := reader.ReadArchive()
+			if !errors.Is(err, tt.want) {
+				t.Errorf("ReadArchive() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// A short archive claiming a large entry fails without allocating for it
+func TestNitroReaderTruncatedAllocation(t *testing.T) {
+	// One entry "x" claiming 0x01f00000 (31 MB) compressed bytes, 3 present
+	data := []byte{0, 1, 0, 1, 'x', 0x01, 0xf0, 0, 0, 1, 2, 3}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := NewNitroReader(bytes.NewReader(data)).ReadArchive()
+	runtime.ReadMemStats(&after)
+
+	if !errors.Is(err, ErrTruncatedArchive) {
+		t.Fatalf("ReadArchive() = %v", err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("allocated %d bytes reading a 12 byte archive", allocated)
+	}
+}
+
+func TestNitroRoundTrip(t *testing.T) {
+	archive := &NitroArchive{}
+	archive.SetFile(NitroFile{Name: "chair.json", Data: []byte(aliasedChairJSON)})
+	archive.SetFile(NitroFile{Name: "chair.png", Data: bytes.Repeat([]byte{1, 2, 3}, 500)})
+	archive.SetFile(NitroFile{Name: "empty", Data: []byte{}})
+	var buf bytes.Buffer
+	writer := NewNitroWriter(&buf)
+	writer.Level = zlib.BestSpeed
+	if err := writer.WriteArchive(archive); err != nil {
+		t.Fatal(err)
+	}
+	original := buf.Bytes()
+
+	read, err := parseNitroArchive(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read.Order) != 3 || read.Order[0] != "chair.json" || read.Order[2] != "empty" {
+		t.Fatalf("Order = %v", read.Order)
+	}
+	for name, file := range archive.Files {
+		if !bytes.Equal(read.Files[name].Data, file.Data) {
+			t.Errorf("%s changed in the round trip", name)
+		}
+	}
+
+	// Unchanged entries are written back as they were read, whatever the level
+	var again bytes.Buffer
+	writer = NewNitroWriter(&again)
+	writer.ReuseCompressed = true
+	if err := writer.WriteArchive(read); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again.Bytes(), original) {
+		t.Error("rewriting an unchanged archive changed its bytes")
+	}
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Errors applying a patch. A failed test operation means the JSON changed
+// since the client read it.
+var (
+	ErrInvalidPatch    = errors.New("invalid patch")
+	ErrPatchTestFailed = errors.New("test failed")
+)
+
+// Media types of the patch formats
+const (
+	jsonPatchType  = "application/json-patch+json"
+	mergePatchType = "application/merge-patch+json"
+)
+
+// pointerUnescaper undoes pointerEscaper
+var pointerUnescaper = strings.NewReplacer("~1", "/", "~0", "~")
+
+// parsePointer splits a JSON pointer (RFC 6901) into its unescaped tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if pointer[0] != '/' {
+		return nil, fmt.Errorf("%w: pointer %q doesn't start with /", ErrInvalidPatch, pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = pointerUnescaper.Replace(token)
+	}
+	return tokens, nil
+}
+
+// jsonMember is a member of an object or an element of an array, by its
+// offsets in the document
+type jsonMember struct {
+	key        string
+	start      int // of the key, or of the value in arrays
+	valueStart int
+	end        int
+}
+
+// jsonContainer is an object or array, by its offsets in the document
+type jsonContainer struct {
+	kind    json.Delim
+	open    int
+	close   int
+	members []jsonMember
+}
+
+// skipSpace returns the offset of the first byte from i that isn't JSON
+// whitespace or one of extra
+func skipSpace(data []byte, i int, extra string) int {
+	for i < len(data) && (strings.IndexByte(" \t\r\n", data[i]) >= 0 || strings.IndexByte(extra, data[i]) >= 0) {
+		i++
+	}
+	return i
+}
+
+// patchDoc is a JSON document patched in place: values are replaced,
+// inserted and removed by their offsets, so whatever a patch doesn't touch
+// keeps its exact bytes
+type patchDoc struct {
+	data []byte
+}
+
+// container parses the object or array that starts at data[start]
+func (d *patchDoc) container(start int) (*jsonContainer, error) {
+	dec := json.NewDecoder(bytes.NewReader(d.data[start:]))
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	kind, ok := tok.(json.Delim)
+	if !ok {
+		return nil, fmt.Errorf("%w: not an object or array", ErrInvalidPatch)
+	}
+	c := &jsonContainer{kind: kind, open: start}
+	prev := start + 1
+	for dec.More() {
+		m := jsonMember{start: skipSpace(d.data, prev, ",")}
+		m.valueStart = m.start
+		if kind == '{' {
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			m.key = tok.(string)
+			m.valueStart = skipSpace(d.data, start+int(dec.InputOffset()), ":")
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		m.end = m.valueStart + len(value)
+		prev = m.end
+		c.members = append(c.members, m)
+	}
+	c.close = skipSpace(d.data, prev, "")
+	return c, nil
+}
+
+// index returns the member of c a pointer token names. For arrays, "-" and
+// the length name the place past the last element, which only add uses.
+func (c *jsonContainer) index(token string) (int, error) {
+	if c.kind == '{' {
+		for i := len(c.members) - 1; i >= 0; i-- {
+			if c.members[i].key == token {
+				return i, nil
+			}
+		}
+		return -1, fmt.Errorf("%w: no member %q", ErrInvalidPatch, token)
+	}
+	if token == "-" {
+		return len(c.members), nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (len(token) > 1 && token[0] == '0') || i > len(c.members) {
+		return -1, fmt.Errorf("%w: no element %q", ErrInvalidPatch, token)
+	}
+	return i, nil
+}
+
+// find returns the offsets of the value at path
+func (d *patchDoc) find(path []string) (int, int, error) {
+	start := skipSpace(d.data, 0, "")
+	end := len(bytes.TrimRight(d.data, " \t\r\n"))
+	for n, token := range path {
+		c, err := d.container(start)
+		if err != nil {
+			return 0, 0, fmt.Errorf("%w: /%s isn't an object or array", ErrInvalidPatch, strings.Join(path[:n], "/"))
+		}
+		i, err := c.index(token)
+		if err != nil {
+			return 0, 0, err
+		}
+		if i == len(c.members) {
+			return 0, 0, fmt.Errorf("%w: no element %q", ErrInvalidPatch, token)
+		}
+		start, end = c.members[i].valueStart, c.members[i].end
+	}
+	return start, end, nil
+}
+
+// parent returns the container holding the value at path
+func (d *patchDoc) parent(path []string) (*jsonContainer, error) {
+	start, _, err := d.find(path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	return d.container(start)
+}
+
+func (d *patchDoc) splice(start, end int, insert []byte) {
+	data := make([]byte, 0, len(d.data)-(end-start)+len(insert))
+	data = append(data, d.data[:start]...)
+	data = append(data, insert...)
+	d.data = append(data, d.data[end:]...)
+}
+
+func (d *patchDoc) get(path []string) ([]byte, error) {
+	start, end, err := d.find(path)
+	if err != nil {
+		return nil, err
+	}
+	return d.data[start:end], nil
+}
+
+// add sets the member of an object or inserts an element into an array
+func (d *patchDoc) add(path []string, value []byte) error {
+	if len(path) == 0 {
+		start, end, _ := d.find(nil)
+		d.splice(start, end, value)
+		return nil
+	}
+	c, err := d.parent(path)
+	if err != nil {
+		return err
+	}
+	token := path[len(path)-1]
+	if c.kind == '{' {
+		if i, err := c.index(token); err == nil {
+			d.splice(c.members[i].valueStart, c.members[i].end, value)
+			return nil
+		}
+		key, _ := marshalJSON(token)
+		member := append(append(key, ':'), value...)
+		d.insert(c, len(c.members), member)
+		return nil
+	}
+	i, err := c.index(token)
+	if err != nil {
+		return err
+	}
+	d.insert(c, i, value)
+	return nil
+}
+
+// insert puts a member before member i of c, or after the last one
+func (d *patchDoc) insert(c *jsonContainer, i int, member []byte) {
+	switch {
+	case len(c.members) == 0:
+		d.splice(c.open+1, c.open+1, member)
+	case i < len(c.members):
+		d.splice(c.members[i].start, c.members[i].start, append(member, ','))
+	default:
+		last := c.members[len(c.members)-1].end
+		d.splice(last, last, append([]byte{','}, member...))
+	}
+}
+
+// remove removes a member of an object or an element of an array, with the
+// comma that separated it
+func (d *patchDoc) remove(path []string) error {
+	if len(path) == 0 {
+		return fmt.Errorf("%w: can't remove the whole document", ErrInvalidPatch)
+	}
+	c, err := d.parent(path)
+	if err != nil {
+		return err
+	}
+	i, err := c.index(path[len(path)-1])
+	if err != nil {
+		return err
+	}
+	if i == len(c.members) {
+		return fmt.Errorf("%w: no element %q", ErrInvalidPatch, path[len(path)-1])
+	}
+	switch {
+	case len(c.members) == 1:
+		d.splice(c.open+1, c.close, nil)
+	case i == 0:
+		d.splice(c.members[0].start, c.members[1].start, nil)
+	default:
+		d.splice(c.members[i-1].end, c.members[i].end, nil)
+	}
+	return nil
+}
+
+// patchOperation is an operation of a JSON Patch (RFC 6902)
+type patchOperation struct {
+	Op    string          `json:"op"`
+	Path  *string         `json:"path"`
+	From  *string         `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+func (d *patchDoc) apply(op patchOperation) error {
+	if op.Path == nil {
+		return fmt.Errorf("%w: %s without path", ErrInvalidPatch, op.Op)
+	}
+	path, err := parsePointer(*op.Path)
+	if err != nil {
+		return err
+	}
+	var value []byte
+	if op.Value != nil {
+		var compact bytes.Buffer
+		json.Compact(&compact, op.Value)
+		value = compact.Bytes()
+	}
+	needs := func(what string, ok bool) error {
+		if !ok {
+			return fmt.Errorf("%w: %s without %s", ErrInvalidPatch, op.Op, what)
+		}
+		return nil
+	}
+
+	switch op.Op {
+	case "add":
+		if err := needs("value", value != nil); err != nil {
+			return err
+		}
+		return d.add(path, value)
+	case "remove":
+		return d.remove(path)
+	case "replace":
+		if err := needs("value", value != nil); err != nil {
+			return err
+		}
+		start, end, err := d.find(path)
+		if err != nil {
+			return err
+		}
+		d.splice(start, end, value)
+		return nil
+	case "move", "copy":
+		if err := needs("from", op.From != nil); err != nil {
+			return err
+		}
+		from, err := parsePointer(*op.From)
+		if err != nil {
+			return err
+		}
+		moved, err := d.get(from)
+		if err != nil {
+			return err
+		}
+		moved = append([]byte(nil), moved...)
+		if op.Op == "move" {
+			if *op.Path == *op.From {
+				return nil
+			}
+			if strings.HasPrefix(*op.Path, *op.From+"/") {
+				return fmt.Errorf("%w: can't move %s into itself", ErrInvalidPatch, *op.From)
+			}
+			if err := d.remove(from); err != nil {
+				return err
+			}
+		}
+		return d.add(path, moved)
+	case "test":
+		if err := needs("value", value != nil); err != nil {
+			return err
+		}
+		current, err := d.get(path)
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrPatchTestFailed, *op.Path, err)
+		}
+		if !jsonEqual(current, value) {
+			return fmt.Errorf("%w: %s is %s", ErrPatchTestFailed, *op.Path, current)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: unknown op %q", ErrInvalidPatch, op.Op)
+}
+
+// jsonEqual compares JSON values as RFC 6902 test does: numbers by value,
+// objects regardless of key order
+func jsonEqual(a, b []byte) bool {
+	var x, y interface{}
+	if json.Unmarshal(a, &x) != nil || json.Unmarshal(b, &y) != nil {
+		return false
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+// applyJSONPatch applies a JSON Patch (RFC 6902) to data. Operations apply
+// in order and all or none do.
+func applyJSONPatch(data, patch []byte) ([]byte, error) {
+	var ops []patchOperation
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+	}
+	doc := &patchDoc{data: append([]byte(nil), data...)}
+	for i, op := range ops {
+		if err := doc.apply(op); err != nil {
+			return nil, fmt.Errorf("operation %d: %w", i, err)
+		}
+	}
+	return doc.data, nil
+}
+
+// applyMergePatch applies a JSON Merge Patch (RFC 7396) to data
+func applyMergePatch(data, patch []byte) ([]byte, error) {
+	if !json.Valid(patch) {
+		return nil, fmt.Errorf("%w: not JSON", ErrInvalidPatch)
+	}
+	doc := &patchDoc{data: append([]byte(nil), data...)}
+	if err := doc.merge(nil, patch); err != nil {
+		return nil, err
+	}
+	return doc.data, nil
+}
+
+// merge merges patch into the value at path: objects member by member,
+// with null removing a member, anything else replacing the value
+func (d *patchDoc) merge(path []string, patch []byte) error {
+	keys, values, err := readObject(patch)
+	if err != nil {
+		var compact bytes.Buffer
+		json.Compact(&compact, patch)
+		return d.add(path, compact.Bytes())
+	}
+	if target, err := d.get(path); err != nil || !bytes.HasPrefix(target, []byte("{")) {
+		if err := d.add(path, []byte("{}")); err != nil {
+			return err
+		}
+	}
+	for _, key := range keys {
+		member := append(path[:len(path):len(path)], key)
+		if string(values[key]) == "null" {
+			if _, err := d.get(member); err == nil {
+				if err := d.remove(member); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err := d.merge(member, values[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// patchNitroJSON applies a JSON Patch or JSON Merge Patch to the furni JSON,
+// chosen by Content-Type, or by the body being an array or an object
+func patchNitroJSON(c *gin.Context) {
+	ws := requestWorkspace(c)
+	if ws == nil {
+		return
+	}
+
+	filename := c.Param("filename")
+	if filepath.Ext(filename) != ".nitro" {
+		filename = filename + ".nitro"
+	}
+	patch, err := c.GetRawData()
+	if err != nil {
+		log.Printf("[ERROR] patchNitroJSON: error reading patch: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Error reading patch: " + err.Error()})
+		return
+	}
+	jsonPatch := c.ContentType() == jsonPatchType
+	if c.ContentType() != jsonPatchType && c.ContentType() != mergePatchType {
+		jsonPatch = bytes.HasPrefix(bytes.TrimSpace(patch), []byte("["))
+	}
+	log.Printf("[DEBUG] patchNitroJSON: patching %s (JSON Patch: %t)", filename, jsonPatch)
+
+	// Every writer of the file takes its lock, so what a test operation
+	// checks holds until the patch is saved
+	unlock := ws.lockFiles(filename)
+	defer unlock()
+
+	lib, err := LoadNitroLibrary(ws.Store, filename)
+	if err != nil {
+		log.Printf("[ERROR] patchNitroJSON: error loading nitro library: %v", err)
+		c.JSON(nitroErrorStatus(err), gin.H{"error": "Error loading .nitro file: " + err.Error()})
+		return
+	}
+
+	var patched []byte
+	if jsonPatch {
+		patched, err = applyJSONPatch(lib.OriginalJSON, patch)
+	} else {
+		patched, err = applyMergePatch(lib.OriginalJSON, patch)
+	}
+	if err != nil {
+		log.Printf("[ERROR] patchNitroJSON: %v", err)
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrPatchTestFailed) {
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{"error": "Error applying patch: " + err.Error()})
+		return
+	}
+
+	problems, err := ValidateFurniJSON(patched)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "JSON inválido: " + err.Error()})
+		return
+	}
+	if len(problems) > 0 {
+		log.Printf("[ERROR] patchNitroJSON: %d schema errors, first: %v", len(problems), problems[0])
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid furni JSON: " + problems[0].Error(), "errors": problems})
+		return
+	}
+	if err := lib.UpdateJSONContent(patched); err != nil {
+		log.Printf("[ERROR] patchNitroJSON: error updating JSON content: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Error updating JSON content: " + err.Error()})
+		return
+	}
+
+	revision, err := saveWithRevision(lib, ws, filename, requestAuthor(c), "patch")
+	if err != nil {
+		log.Printf("[ERROR] patchNitroJSON: error saving nitro file: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving .nitro file: " + err.Error()})
+		return
+	}
+	log.Printf("[DEBUG] patchNitroJSON: JSON patched successfully for %s", filename)
+	response := gin.H{"message": "JSON patched successfully"}
+	if revision != nil {
+		response["revision"] = revision.Number
+	}
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// patchSource is formatted the way editors leave JSON, to check patches keep it
+const patchSource = "{\n  \"name\": \"chair\",\n  \"n\": 1.50,\n  \"arr\": [1, 2,  3],\n  \"obj\": {\"a\": 1, \"b\": {\"c\": 2}}\n}\n"
+
+func TestJSONPatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		doc   string
+		patch string
+		want  string
+	}{
+		// RFC 6902, Appendix A
+		{"A.1 add member", `{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"foo":"bar","baz":"qux"}`},
+		{"A.2 add element", `{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`},
+		{"A.3 remove member", `{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`},
+		{"A.4 remove element", `{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`},
+		{"A.5 replace", `{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`},
+		{"A.6 move member", `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`,
+			`[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`, `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{"A.7 move element", `{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`},
+		{"A.8 test", `{"baz":"qux","foo":["a",2,"c"]}`,
+			`[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`, `{"baz":"qux","foo":["a",2,"c"]}`},
+		{"A.10 add nested", `{"foo":"bar"}`, `[{"op":"add","path":"/child","value":{"grandchild":{}}}]`, `{"foo":"bar","child":{"grandchild":{}}}`},
+		{"A.11 ignore unknown members", `{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux","xyz":123}]`, `{"foo":"bar","baz":"qux"}`},
+		{"A.14 escapes", `{"/":9,"~1":10}`, `[{"op":"test","path":"/~01","value":10},{"op":"test","path":"/~1","value":9}]`, `{"/":9,"~1":10}`},
+		{"A.16 add array", `{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`, `{"foo":["bar",["abc","def"]]}`},
+
+		// Escaped tokens
+		{"replace escaped", `{"a/b":1,"m~n":2}`, `[{"op":"replace","path":"/a~1b","value":3},{"op":"remove","path":"/m~0n"}]`, `{"a/b":3}`},
+		{"add escaped", `{}`, `[{"op":"add","path":"/x~1y~0","value":1}]`, `{"x/y~":1}`},
+		{"copy escaped", `{"~":[1]}`, `[{"op":"copy","from":"/~0/0","path":"/~1"}]`, `{"~":[1],"/":1}`},
+
+		// Empty containers and the whole document
+		{"add to empty object", `{"a":{}}`, `[{"op":"add","path":"/a/b","value":1}]`, `{"a":{"b":1}}`},
+		{"add to empty array", `{"a":[]}`, `[{"op":"add","path":"/a/0","value":1}]`, `{"a":[1]}`},
+		{"append to empty array", `{"a":[ ]}`, `[{"op":"add","path":"/a/-","value":1}]`, `{"a":[1 ]}`},
+		{"remove last member", `{"a":{ "b": 1 }}`, `[{"op":"remove","path":"/a/b"}]`, `{"a":{}}`},
+		{"remove last element", `{"a":[1]}`, `[{"op":"remove","path":"/a/0"}]`, `{"a":[]}`},
+		{"add empty containers", `{}`, `[{"op":"add","path":"/a","value":{}},{"op":"add","path":"/b","value":[]}]`, `{"a":{},"b":[]}`},
+		{"replace document", ` {"a":1} `, `[{"op":"replace","path":"","value":[1]}]`, ` [1] `},
+		{"add document", `{"a":1}`, `[{"op":"add","path":"","value":{"b":2}}]`, `{"b":2}`},
+		{"test equal numbers", `{"a":1.50,"b":{"x":1,"y":2}}`,
+			`[{"op":"test","path":"/a","value":1.5},{"op":"test","path":"/b","value":{"y":2,"x":1}}]`, `{"a":1.50,"b":{"x":1,"y":2}}`},
+		{"empty patch", patchSource, `[]`, patchSource},
+
+		// Whatever an operation doesn't touch keeps its formatting
+		{"replace keeps whitespace", patchSource, `[{"op":"replace","path":"/name","value":"x"}]`,
+			"{\n  \"name\": \"x\",\n  \"n\": 1.50,\n  \"arr\": [1, 2,  3],\n  \"obj\": {\"a\": 1, \"b\": {\"c\": 2}}\n}\n"},
+		{"remove first keeps whitespace", patchSource, `[{"op":"remove","path":"/name"}]`,
+			"{\n  \"n\": 1.50,\n  \"arr\": [1, 2,  3],\n  \"obj\": {\"a\": 1, \"b\": {\"c\": 2}}\n}\n"},
+		{"remove last keeps whitespace", patchSource, `[{"op":"remove","path":"/obj"}]`,
+			"{\n  \"name\": \"chair\",\n  \"n\": 1.50,\n  \"arr\": [1, 2,  3]\n}\n"},
+		{"add elements keeps whitespace", patchSource, `[{"op":"add","path":"/arr/-","value":4},{"op":"add","path":"/arr/0","value":0}]`,
+			"{\n  \"name\": \"chair\",\n  \"n\": 1.50,\n  \"arr\": [0,1, 2,  3,4],\n  \"obj\": {\"a\": 1, \"b\": {\"c\": 2}}\n}\n"},
+		{"move keeps whitespace", patchSource, `[{"op":"move","from":"/obj/b","path":"/z"}]`,
+			"{\n  \"name\": \"chair\",\n  \"n\": 1.50,\n  \"arr\": [1, 2,  3],\n  \"obj\": {\"a\": 1},\"z\":{\"c\": 2}\n}\n"},
+		{"copy keeps whitespace", patchSource, `[{"op":"copy","from":"/obj/a","path":"/obj/b/d"}]`,
+			"{\n  \"name\": \"chair\",\n  \"n\": 1.50,\n  \"arr\": [1, 2,  3],\n  \"obj\": {\"a\": 1, \"b\": {\"c\": 2,\"d\":1}}\n}\n"},
+		{"values are compacted", patchSource, `[{"op":"replace","path":"/obj/b","value":{ "c" : [ 1, 2 ] }}]`,
+			"{\n  \"name\": \"chair\",\n  \"n\": 1.50,\n  \"arr\": [1, 2,  3],\n  \"obj\": {\"a\": 1, \"b\": {\"c\":[1,2]}}\n}\n"},
+		{"remove every element", patchSource, `[{"op":"remove","path":"/arr/1"},{"op":"remove","path":"/arr/0"},{"op":"remove","path":"/arr/0"}]`,
+			"{\n  \"name\": \"chair\",\n  \"n\": 1.50,\n  \"arr\": [],\n  \"obj\": {\"a\": 1, \"b\": {\"c\": 2}}\n}\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := applyJSONPatch([]byte(tt.doc), []byte(tt.patch))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONPatchErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		doc   string
+		patch string
+		want  error
+	}{
+		{"A.9 test fails", `{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"bar"}]`, ErrPatchTestFailed},
+		{"A.12 add to missing parent", `{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`, ErrInvalidPatch},
+		{"A.15 test string against number", `{"/":9,"~1":10}`, `[{"op":"test","path":"/~01","value":"10"}]`, ErrPatchTestFailed},
+		{"test missing member", `{}`, `[{"op":"test","path":"/a","value":1}]`, ErrPatchTestFailed},
+		{"add into a string", `{"a":"b"}`, `[{"op":"add","path":"/a/b","value":1}]`, ErrInvalidPatch},
+		{"remove missing member", patchSource, `[{"op":"remove","path":"/nope"}]`, ErrInvalidPatch},
+		{"remove past the end", patchSource, `[{"op":"remove","path":"/arr/3"}]`, ErrInvalidPatch},
+		{"remove document", patchSource, `[{"op":"remove","path":""}]`, ErrInvalidPatch},
+		{"add past the end", patchSource, `[{"op":"add","path":"/arr/4","value":1}]`, ErrInvalidPatch},
+		{"replace with leading zero", patchSource, `[{"op":"replace","path":"/arr/01","value":1}]`, ErrInvalidPatch},
+		{"replace dash", patchSource, `[{"op":"replace","path":"/arr/-","value":1}]`, ErrInvalidPatch},
+		{"move into itself", patchSource, `[{"op":"move","from":"/obj","path":"/obj/x"}]`, ErrInvalidPatch},
+		{"copy missing", patchSource, `[{"op":"copy","from":"/nope","path":"/x"}]`, ErrInvalidPatch},
+		{"unknown op", patchSource, `[{"op":"bad","path":""}]`, ErrInvalidPatch},
+		{"no path", patchSource, `[{"op":"remove"}]`, ErrInvalidPatch},
+		{"no value", patchSource, `[{"op":"add","path":"/x"}]`, ErrInvalidPatch},
+		{"no from", patchSource, `[{"op":"move","path":"/x"}]`, ErrInvalidPatch},
+		{"relative pointer", patchSource, `[{"op":"remove","path":"name"}]`, ErrInvalidPatch},
+		{"not an array", patchSource, `{"op":"remove","path":"/name"}`, ErrInvalidPatch},
+		{"fails after an operation applied", patchSource,
+			`[{"op":"remove","path":"/name"},{"op":"test","path":"/name","value":"chair"}]`, ErrPatchTestFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := []byte(tt.doc)
+			got, err := applyJSONPatch(doc, []byte(tt.patch))
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("error = %v, want %v", err, tt.want)
+			}
+			if got != nil || string(doc) != tt.doc {
+				t.Errorf("failed patch changed the document: %q", got)
+			}
+		})
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		doc    string
+		patch  string
+		want   string
+		layout bool // want is also the exact formatting, not just the value
+	}{
+		// RFC 7396, Appendix A
+		{"A replace", `{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`, false},
+		{"A add", `{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`, false},
+		{"A remove", `{"a":"b"}`, `{"a":null}`, `{}`, false},
+		{"A remove one", `{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`, false},
+		{"A array by string", `{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`, false},
+		{"A string by array", `{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`, false},
+		{"A nested", `{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`, false},
+		{"A arrays aren't merged", `{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`, false},
+		{"A array document", `["a","b"]`, `["c","d"]`, `["c","d"]`, false},
+		{"A array patch", `{"a":"b"}`, `["c"]`, `["c"]`, false},
+		{"A null patch", `{"a":"foo"}`, `null`, `null`, false},
+		{"A string patch", `{"a":"foo"}`, `"bar"`, `"bar"`, false},
+		{"A null members stay", `{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`, false},
+		{"A object patch on array", `[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`, false},
+		{"A null in new object", `{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`, false},
+
+		{"keeps whitespace", patchSource, `{"name":null,"obj":{"b":{"c":null,"e":[1]},"a":"s"},"new":{"x":null,"y":1},"arr":5}`,
+			"{\n  \"n\": 1.50,\n  \"arr\": 5,\n  \"obj\": {\"a\": \"s\", \"b\": {\"e\":[1]}},\"new\":{\"y\":1}\n}\n", true},
+		{"empty patch", patchSource, `{}`, patchSource, true},
+		{"remove missing", patchSource, `{"nope":null}`, patchSource, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := applyMergePatch([]byte(tt.doc), []byte(tt.patch))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.layout && string(got) != tt.want || !jsonEqual(got, []byte(tt.want)) {
+				t.Errorf("got\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := applyMergePatch([]byte(patchSource), []byte(`{"a":`)); !errors.Is(err, ErrInvalidPatch) {
+		t.Errorf("invalid patch: %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PreviewRequest renders a stored furni with the internal compositor. JSON,
+// when given, replaces the furni JSON for this render only, so edits can be
+// previewed before they are saved.
+type PreviewRequest struct {
+	RenderRequest
+	JSON json.RawMessage `json:"json,omitempty"`
+}
+
+// renderPreviewFile renders a preview to ../static in the requested format
+func renderPreviewFile(ws *Workspace, req PreviewRequest) (*RenderOutput, error) {
+	if req.FromState != nil {
+		return nil, fmt.Errorf("%w: previews don't render transitions", ErrInvalidRender)
+	}
+	filename := req.Filename
+	if !strings.HasSuffix(filename, ".nitro") {
+		filename += ".nitro"
+	}
+	data, err := ws.Store.Get(filename)
+	if err != nil {
+		return nil, err
+	}
+	lib, err := ParseNitroLibrary(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.JSON) > 0 {
+		// Unsaved JSON gets the checks a save would make
+		problems, err := ValidateFurniJSON(req.JSON)
+		if err != nil {
+			return nil, fmt.Errorf("%w: error parsing JSON: %v", ErrInvalidRender, err)
+		}
+		if len(problems) > 0 {
+			return nil, fmt.Errorf("%w: invalid furni JSON: %v", ErrInvalidRender, problems[0])
+		}
+		var furni NitroFurni
+		if err := json.Unmarshal(req.JSON, &furni); err != nil {
+			return nil, fmt.Errorf("%w: error parsing JSON: %v", ErrInvalidRender, err)
+		}
+		lib.Furni, lib.OriginalJSON = &furni, req.JSON
+	}
+
+	if req.Format, err = renderFormat(req.Format); err != nil {
+		return nil, err
+	}
+	key := renderKey(ws, data, req)
+	if output, ok := renderCache.Get(key); ok {
+		return output, nil
+	}
+
+	comp, err := NewCompositor(lib)
+	if err != nil {
+		return nil, err
+	}
+	render := req.RenderRequest
+	if render.Size == 0 {
+		if sizes := comp.Sizes(); len(sizes) > 0 {
+			render.Size = sizes[0]
+		}
+	}
+	direction, err := comp.Direction(render.Size, render.Direction)
+	if err != nil {
+		return nil, err
+	}
+	checks := &renderChecks{strict: render.Strict}
+	if err := checkRender(lib.Furni, render, direction, render.State, checks); err != nil {
+		return nil, err
+	}
+	style, err := parseRenderStyle(render, render.Size)
+	if err != nil {
+		return nil, err
+	}
+	if err := resolveFrameCount(lib.Furni, &render); err != nil {
+		return nil, err
+	}
+	frameCount := 1
+	if render.State > 0 {
+		frameCount = comp.PlayLength(render.Size, render.State)
+	}
+	timing, err := parseFrameTiming(render, frameCount)
+	if err != nil {
+		return nil, err
+	}
+	if render.Format == formatPNG {
+		timing.count = 1
+	}
+
+	spec := compositeSpec{
+		Size:      render.Size,
+		Direction: direction,
+		State:     render.State,
+		Color:     render.Color,
+		Shadow:    render.Shadow,
+	}
+	frames, err := comp.Render(spec, timing.start, timing.count)
+	if err != nil {
+		return nil, err
+	}
+	frames = style.apply(frames)
+
+	name := lib.Furni.Name
+	if name == "" {
+		name = strings.TrimSuffix(filename, ".nitro")
+	}
+	os.MkdirAll("../static", 0755)
+	base := ws.renderPrefix() + fmt.Sprintf("%s_s%d_d%d_st%d_c%d_preview_%s",
+		name, render.Size, direction, render.State, render.Color, key)
+	output := &RenderOutput{Format: render.Format, Direction: direction, State: render.State, Color: render.Color, Warnings: checks.warnings}
+	if err := writeRenderFrames(output, frames, base, timing); err != nil {
+		return nil, err
+	}
+	renderCache.Add(key, output, renderOwner(ws, filename))
+	return output, nil
+}
+
+// renderPreview renders a furni with the internal compositor, optionally
+// with unsaved JSON
+func renderPreview(c *gin.Context) {
+	ws := requestWorkspace(c)
+	if ws == nil {
+		return
+	}
+
+	var req PreviewRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		log.Printf("[ERROR] renderPreview: error binding JSON: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("[DEBUG] renderPreview: rendering %s (unsaved JSON: %t)", req.Filename, len(req.JSON) > 0)
+
+	output, err := renderPreviewFile(ws, req)
+	if err != nil {
+		log.Printf("[ERROR] renderPreview: %v", err)
+		c.JSON(nitroErrorStatus(err), gin.H{"error": "Error rendering preview: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, renderResponse(output))
+}
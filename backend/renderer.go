@@ -1,9 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"os"
-	"path/filepath"
+	"strconv"
 	"strings"
 
 	"xabbo.io/nx/imager"
@@ -44,8 +46,55 @@ func NewSimpleLibraryManager(lib res.FurniLibrary) *SimpleLibraryManager {
 	return &SimpleLibraryManager{lib: lib}
 }
 
-// renderFurniToGIF renderiza un mueble a GIF usando el sistema de imager de nx
-func renderFurniToGIF(req RenderRequest) (string, error) {
+// ErrInvalidRender is wrapped by errors about render parameters, which the
+// handlers report as 400 Bad Request
+var ErrInvalidRender = errors.New("invalid render request")
+
+// renderChecks collects the fallbacks a render takes when it can't render
+// exactly what was asked. Strict renders fail on the first one instead.
+type renderChecks struct {
+	strict   bool
+	warnings []string
+}
+
+// fallback records a fallback, or returns it as an error in strict mode
+func (rc *renderChecks) fallback(format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	if rc.strict {
+		return fmt.Errorf("%w: %s", ErrInvalidRender, msg)
+	}
+	rc.warnings = append(rc.warnings, msg)
+	return nil
+}
+
+// checkRender reports the fallbacks of rendering state and color of a
+// furni at size in direction, when direction was requested
+func checkRender(furni *NitroFurni, req RenderRequest, direction, state int, checks *renderChecks) error {
+	if direction != req.Direction {
+		if err := checks.fallback("direction %d not available, used %d", req.Direction, direction); err != nil {
+			return err
+		}
+	}
+	vis := furni.visualization(req.Size)
+	if vis == nil {
+		return nil
+	}
+	if _, ok := vis.Animations[strconv.Itoa(state)]; !ok && state != 0 {
+		if err := checks.fallback("state %d has no animation", state); err != nil {
+			return err
+		}
+	}
+	if _, ok := vis.Colors[strconv.Itoa(req.Color)]; !ok && req.Color != 0 {
+		if err := checks.fallback("color %d not available, used the default colors", req.Color); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renderFurniFile renderiza un mueble de un workspace usando el sistema de imager de nx,
+// en el formato pedido (GIF por defecto)
+func renderFurniFile(ws *Workspace, req RenderRequest) (*RenderOutput, error) {
 	fmt.Printf("[DEBUG] Rendering request: %+v\n", req)
 	
 	// Load .nitro file - add extension if it doesn't have one
@@ -53,34 +102,68 @@ func renderFurniToGIF(req RenderRequest) (string, error) {
 	if !strings.HasSuffix(filename, ".nitro") {
 		filename += ".nitro"
 	}
-	filePath := filepath.Join("../uploads", filename)
-	fmt.Printf("[DEBUG] Loading file from path: %s\n", filePath)
+	fmt.Printf("[DEBUG] Loading file from store: %s\n", filename)
 	
 	// Check file timestamp for debug
-	fileInfo, err := os.Stat(filePath)
+	fileInfo, err := ws.Store.Stat(filename)
 	if err == nil {
-		fmt.Printf("[DEBUG] File last modified: %v\n", fileInfo.ModTime())
+		fmt.Printf("[DEBUG] File last modified: %v\n", fileInfo.ModTime)
 	}
 	
-	f, err := os.Open(filePath)
+	data, err := ws.Store.Get(filename)
 	if err != nil {
 		fmt.Printf("[DEBUG] Error opening file: %v\n", err)
-		return "", err
+		return nil, err
+	}
+
+	// Reuse a previous render of the same contents and parameters
+	if req.Format, err = renderFormat(req.Format); err != nil {
+		return nil, err
+	}
+	key := renderKey(ws, data, req)
+	if output, ok := renderCache.Get(key); ok {
+		fmt.Printf("[DEBUG] Render cache hit: %s\n", output.Filename)
+		return output, nil
 	}
-	defer f.Close()
 
+	furni, err := readNitroFurni(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := resolveFrameCount(furni, &req); err != nil {
+		return nil, err
+	}
+	lib, err := loadFurniLibrary(data)
+	if err != nil {
+		return nil, err
+	}
+	var output *RenderOutput
+	if req.FromState != nil {
+		output, err = renderTransition(ws, lib, furni, req, key)
+	} else {
+		output, err = renderLibrary(ws, lib, furni, req, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	renderCache.Add(key, output, renderOwner(ws, filename))
+	return output, nil
+}
+
+// loadFurniLibrary reads the contents of a .nitro file into an nx furni library
+func loadFurniLibrary(data []byte) (res.FurniLibrary, error) {
 	// Read nitro file using nx reader
-	r := nitro.NewReader(f)
+	r := nitro.NewReader(bytes.NewReader(data))
 	archive, err := r.ReadArchive()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	// Load furni library using nx
 	lib, err := res.LoadFurniLibraryNitro(archive)
 	if err != nil {
 		fmt.Printf("[DEBUG] Error loading furni library: %v\n", err)
-		return "", err
+		return nil, err
 	}
 	fmt.Printf("[DEBUG] Library loaded successfully, visualizations: %v\n", len(lib.Visualizations()))
 	
@@ -91,27 +174,79 @@ func renderFurniToGIF(req RenderRequest) (string, error) {
 			fmt.Printf("[DEBUG] Found PNG file: %s (size: %d bytes)\n", file.Name, len(file.Data))
 		}
 	}
+	return lib, nil
+}
 
-	// Crear manager y imager
-	mgr := NewSimpleLibraryManager(lib)
-	imgr := imager.NewFurniImager(mgr)
+// renderLibrary renders one size, direction, state and color of a loaded
+// library to ../static in the requested format, naming the files after the
+// render cache key. It only reads lib, so several renders of the same
+// library can run at once.
+func renderLibrary(ws *Workspace, lib res.FurniLibrary, furni *NitroFurni, req RenderRequest, key string) (*RenderOutput, error) {
+	format, err := renderFormat(req.Format)
+	if err != nil {
+		return nil, err
+	}
+	direction, err := renderDirection(lib, req.Size, req.Direction)
+	if err != nil {
+		return nil, err
+	}
+	checks := &renderChecks{strict: req.Strict}
+	if err := checkRender(furni, req, direction, req.State, checks); err != nil {
+		return nil, err
+	}
+	style, err := parseRenderStyle(req, req.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	// Componer animación
+	anim, err := composeFurni(lib, req, direction, req.State)
+	if err != nil {
+		return nil, err
+	}
+
+	base := renderBaseName(ws, lib, req, direction, fmt.Sprintf("st%d", req.State), key)
 
+	// Crear directorio de salida si no existe
+	os.MkdirAll("../static", 0755)
+
+	// Calcular frameCount como hace nx
+	frameCount := 1
+	if req.State > 0 {
+		// Para animaciones, usar LongestSequence como hace nx
+		frameCount = anim.LongestSequence(0)
+	}
+	timing, err := parseFrameTiming(req, frameCount)
+	if err != nil {
+		return nil, err
+	}
+
+	output := &RenderOutput{Format: format, Direction: direction, State: req.State, Color: req.Color, Warnings: checks.warnings}
+	if err := writeRenderOutput(output, anim, base, style, timing); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+// renderDirection returns the direction a render at size uses: the one
+// requested if the visualization has it, else the first of 2, 4, 6 and 0
+func renderDirection(lib res.FurniLibrary, size, requested int) (int, error) {
 	// Get visualization for specified size
 	fmt.Printf("[DEBUG] Available visualizations: %v\n", len(lib.Visualizations()))
 	for size, v := range lib.Visualizations() {
 		fmt.Printf("[DEBUG] Visualization size %d has %d directions\n", size, len(v.Directions))
 	}
-	vis, ok := lib.Visualizations()[req.Size]
+	vis, ok := lib.Visualizations()[size]
 	if !ok {
-		return "", fmt.Errorf("no visualization for size: %d", req.Size)
+		return 0, fmt.Errorf("%w: no visualization for size: %d", ErrInvalidRender, size)
 	}
-	fmt.Printf("[DEBUG] Selected visualization for size %d has %d directions\n", req.Size, len(vis.Directions))
+	fmt.Printf("[DEBUG] Selected visualization for size %d has %d directions\n", size, len(vis.Directions))
 
 	// Usar la misma lógica que nx: buscar direcciones válidas empezando por 2, 4, 6, 0
-	direction := req.Direction
+	direction := requested
 
 	// Check that direction is available
-	fmt.Printf("[DEBUG] Available directions: %v, requested direction: %d\n", getDirectionKeys(vis.Directions), req.Direction)
+	fmt.Printf("[DEBUG] Available directions: %v, requested direction: %d\n", getDirectionKeys(vis.Directions), requested)
 	if _, ok := vis.Directions[direction]; !ok {
 
 		// Search for first valid direction
@@ -123,73 +258,49 @@ func renderFurniToGIF(req RenderRequest) (string, error) {
 				break
 			}
 		}
-	} else {
-
 	}
+	return direction, nil
+}
+
+// composeFurni composes one state of a furni with the size, color and
+// shadow of req
+func composeFurni(lib res.FurniLibrary, req RenderRequest, direction, state int) (imager.Animation, error) {
+	// Crear manager y imager
+	mgr := NewSimpleLibraryManager(lib)
+	imgr := imager.NewFurniImager(mgr)
 
 	// Crear especificación de furni
 	furni := imager.Furni{
 		Identifier: lib.Name(),
 		Size:       req.Size,
 		Direction:  direction,
-		State:      req.State,
+		State:      state,
 		Color:      req.Color,
-		Shadow:     false, // Desactivar sombra para GIF como hace nx
+		Shadow:     req.Shadow,
 	}
-
-	// Componer animación
 	anim, err := imgr.Compose(furni)
 	if err != nil {
-		return "", err
+		return anim, err
 	}
 
 	// Verificar que la animación tiene capas (como hace nx)
 	if len(anim.Layers) == 0 {
-		return "", fmt.Errorf("no layers in animation for direction %d, state %d", direction, req.State)
+		return anim, fmt.Errorf("no layers in animation for direction %d, state %d", direction, state)
 	}
+	return anim, nil
+}
 
+// renderBaseName is the name of a render in ../static without extension.
+// states describes the state or states rendered, e.g. st1.
+func renderBaseName(ws *Workspace, lib res.FurniLibrary, req RenderRequest, direction int, states, key string) string {
 	// Create output filename
 	libName := lib.Name()
 	if libName == "" {
 		libName = strings.TrimSuffix(req.Filename, ".nitro")
 	}
 	fmt.Printf("[DEBUG] Library name: '%s', using: '%s'\n", lib.Name(), libName)
-	outputFilename := fmt.Sprintf("%s_s%d_d%d_st%d_c%d.gif", 
-		libName, req.Size, direction, req.State, req.Color)
-	outputPath := filepath.Join("../static", outputFilename)
-
-	// Crear directorio de salida si no existe
-	os.MkdirAll("../static", 0755)
-
-	// Delete existing file if it exists to force regeneration
-	if _, err := os.Stat(outputPath); err == nil {
-		os.Remove(outputPath)
-		fmt.Printf("[DEBUG] Removed existing file: %s\n", outputPath)
-	}
-
-	// Create output file
-	outFile, err := os.Create(outputPath)
-	if err != nil {
-		return "", err
-	}
-	defer outFile.Close()
-
-	// Calcular frameCount como hace nx
-	frameCount := 1
-	if req.State > 0 {
-		// Para animaciones, usar LongestSequence como hace nx
-		frameCount = anim.LongestSequence(0)
-	}
-
-	
-	// Render animation to GIF using nx encoder
-	encoder := imager.NewEncoderGIF()
-	err = encoder.EncodeAnimation(outFile, anim, 0, frameCount)
-	if err != nil {
-		return "", err
-	}
-
-	return outputFilename, nil
+	return ws.renderPrefix() + fmt.Sprintf("%s_s%d_d%d_%s_c%d_%s",
+		libName, req.Size, direction, states, req.Color, key)
 }
 
 // Helper function to get direction keys for debugging
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"xabbo.io/nx/imager"
+)
+
+// maxSceneFurni caps the furni of one scene
+const maxSceneFurni = 64
+
+// Scenes are rooms: tiles 0 to maxSceneTiles-1 on each axis, furni heights
+// within maxSceneHeight of the floor
+const (
+	maxSceneTiles  = 64
+	maxSceneHeight = 64
+)
+
+// SceneFurni places a stored furni in a scene at tile X, Y and height Z
+type SceneFurni struct {
+	Filename  string  `json:"filename"`
+	X         int     `json:"x"`
+	Y         int     `json:"y"`
+	Z         float64 `json:"z"`
+	Direction int     `json:"direction"`
+	State     int     `json:"state"`
+	Color     int     `json:"color"`
+}
+
+// SceneRequest asks for several furni of a workspace composed into one
+// isometric image. The presentation and timing options work as in
+// RenderRequest, except that a floor background puts floor tiles under the
+// whole scene.
+type SceneRequest struct {
+	Size       int          `json:"size"`
+	Furni      []SceneFurni `json:"furni"`
+	Format     string       `json:"format,omitempty"`
+	Shadow     bool         `json:"shadow,omitempty"`
+	Background string       `json:"background,omitempty"`
+	Scale      int          `json:"scale,omitempty"`
+	Padding    int          `json:"padding,omitempty"`
+	StartFrame int          `json:"start_frame,omitempty"`
+	FrameCount FrameCount   `json:"frame_count,omitempty"`
+	FPS        int          `json:"fps,omitempty"`
+	DelayMs    int          `json:"delay_ms,omitempty"`
+	LoopCount  *int         `json:"loop_count,omitempty"`
+	Strict     bool         `json:"strict,omitempty"`
+}
+
+// renderRequest returns the options the scene shares with single renders
+func (req SceneRequest) renderRequest() RenderRequest {
+	return RenderRequest{
+		Size:       req.Size,
+		Format:     req.Format,
+		Shadow:     req.Shadow,
+		Background: req.Background,
+		Scale:      req.Scale,
+		Padding:    req.Padding,
+		StartFrame: req.StartFrame,
+		FrameCount: req.FrameCount,
+		FPS:        req.FPS,
+		DelayMs:    req.DelayMs,
+		LoopCount:  req.LoopCount,
+		Strict:     req.Strict,
+	}
+}
+
+// tileOrigin is where the back corner of tile x, y at height z is drawn,
+// relative to the back corner of tile 0, 0 at height 0. Furni are drawn
+// with their registration point there.
+func tileOrigin(size, x, y int, z float64) image.Point {
+	return image.Pt((x-y)*size/2, (x+y)*size/4-int(z*float64(size)/2))
+}
+
+// scenePiece is one furni of a scene, composed and rendered
+type scenePiece struct {
+	SceneFurni
+	loaded *LoadedLibrary
+	anim   imager.Animation
+	at     image.Point // top-left corner of the frames in the scene
+	frames []*image.NRGBA
+}
+
+// footprint returns the tiles a furni covers: its logic dimensions, turned
+// with its direction
+func (p *scenePiece) footprint() (int, int) {
+	dims := p.loaded.Furni.Logic.Model.Dimensions
+	w, l := min(max(1, int(dims.X)), maxSceneTiles), min(max(1, int(dims.Y)), maxSceneTiles)
+	if p.Direction%8 == 2 || p.Direction%8 == 6 {
+		w, l = l, w
+	}
+	return w, l
+}
+
+// renderSceneFile composes the furni of a scene stored in a workspace.
+// Furni are drawn back to front by tile, then by height.
+func renderSceneFile(ws *Workspace, req SceneRequest) (*RenderOutput, error) {
+	if req.Size == 0 {
+		req.Size = 64
+	}
+	if len(req.Furni) == 0 || len(req.Furni) > maxSceneFurni {
+		return nil, fmt.Errorf("%w: a scene needs 1 to %d furni", ErrInvalidRender, maxSceneFurni)
+	}
+	for _, furni := range req.Furni {
+		if furni.X < 0 || furni.X >= maxSceneTiles || furni.Y < 0 || furni.Y >= maxSceneTiles {
+			return nil, fmt.Errorf("%w: %s: tile %d, %d is outside the %dx%d room", ErrInvalidRender, furni.Filename, furni.X, furni.Y, maxSceneTiles, maxSceneTiles)
+		}
+		if furni.Z < -maxSceneHeight || furni.Z > maxSceneHeight {
+			return nil, fmt.Errorf("%w: %s: height %g must be within %d of the floor", ErrInvalidRender, furni.Filename, furni.Z, maxSceneHeight)
+		}
+	}
+	var err error
+	if req.Format, err = renderFormat(req.Format); err != nil {
+		return nil, err
+	}
+	render := req.renderRequest()
+	style, err := parseRenderStyle(render, req.Size)
+	if err != nil {
+		return nil, err
+	}
+	floor := style.floor
+	style.floor = nil
+
+	// Load every furni, then reuse the scene if none of them changed
+	mgr := NewWorkspaceLibraryManager(ws)
+	pieces := make([]*scenePiece, len(req.Furni))
+	var sums []byte
+	var owners []string
+	for i, furni := range req.Furni {
+		loaded, err := mgr.Load(furni.Filename)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", furni.Filename, err)
+		}
+		pieces[i] = &scenePiece{SceneFurni: furni, loaded: loaded}
+		sums = append(sums, loaded.Sum[:]...)
+		owners = append(owners, renderOwner(ws, loaded.Filename))
+	}
+	key := renderKey(ws, sums, req)
+	if output, ok := renderCache.Get(key); ok {
+		return output, nil
+	}
+
+	checks := &renderChecks{strict: req.Strict}
+	frameCount, loopLength := 1, 1
+	for _, p := range pieces {
+		lib := p.loaded.Lib
+		direction, err := renderDirection(lib, req.Size, p.Direction)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p.Filename, err)
+		}
+		pieceChecks := &renderChecks{strict: req.Strict}
+		pieceRender := RenderRequest{Size: req.Size, Direction: p.Direction, State: p.State, Color: p.Color}
+		if err := checkRender(p.loaded.Furni, pieceRender, direction, p.State, pieceChecks); err != nil {
+			return nil, fmt.Errorf("%s: %w", p.Filename, err)
+		}
+		for _, warning := range pieceChecks.warnings {
+			checks.warnings = append(checks.warnings, p.Filename+": "+warning)
+		}
+		p.Direction = direction
+
+		// Each piece composes with a manager of its own library: pieces can
+		// be different files with the same furni name
+		imgr := imager.NewFurniImager(NewSimpleLibraryManager(lib))
+		p.anim, err = imgr.Compose(imager.Furni{
+			Identifier: lib.Name(),
+			Size:       req.Size,
+			Direction:  direction,
+			State:      p.State,
+			Color:      p.Color,
+			Shadow:     req.Shadow,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p.Filename, err)
+		}
+		if len(p.anim.Layers) == 0 {
+			return nil, fmt.Errorf("%s: no layers in animation for direction %d, state %d", p.Filename, direction, p.State)
+		}
+		// The frames are cropped to the animation, its origin being the
+		// registration point
+		p.at = tileOrigin(req.Size, p.X, p.Y, p.Z).Add(p.anim.Bounds(0).Min)
+
+		if p.State > 0 {
+			frameCount = max(frameCount, p.anim.LongestSequence(0))
+		}
+		if loopLength <= maxAnimationFrames {
+			loopLength = lcm(loopLength, p.loaded.Furni.LoopLength(req.Size, p.State))
+		}
+	}
+
+	if render.FrameCount == FrameCountAuto {
+		if loopLength > maxAnimationFrames {
+			return nil, fmt.Errorf("%w: the scene loops after more than %d frames", ErrInvalidRender, maxAnimationFrames)
+		}
+		render.FrameCount = FrameCount(loopLength)
+	}
+	timing, err := parseFrameTiming(render, frameCount)
+	if err != nil {
+		return nil, err
+	}
+	if req.Format == formatPNG {
+		timing.count = 1
+	}
+
+	// The scene is as large as its furni and floor tiles together
+	var bounds image.Rectangle
+	for _, p := range pieces {
+		p.frames, err = renderFrames(p.anim, 0, timing.start, timing.count)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p.Filename, err)
+		}
+		bounds = bounds.Union(p.frames[0].Bounds().Add(p.at))
+	}
+	var tiles []image.Rectangle
+	thickness := req.Size / 8
+	if floor != nil {
+		minX, minY, maxX, maxY := pieces[0].X, pieces[0].Y, pieces[0].X, pieces[0].Y
+		for _, p := range pieces {
+			w, l := p.footprint()
+			minX, minY = min(minX, p.X), min(minY, p.Y)
+			maxX, maxY = max(maxX, p.X+w-1), max(maxY, p.Y+l-1)
+		}
+		// Back tiles first, so the sides of the front ones stay on top
+		for depth := minX + minY; depth <= maxX+maxY; depth++ {
+			for x := minX; x <= maxX; x++ {
+				y := depth - x
+				if y < minY || y > maxY {
+					continue
+				}
+				o := tileOrigin(req.Size, x, y, 0)
+				tile := image.Rect(o.X-req.Size/2, o.Y, o.X+req.Size/2, o.Y+req.Size/2+thickness)
+				tiles = append(tiles, tile)
+				bounds = bounds.Union(tile)
+			}
+		}
+	}
+
+	sort.SliceStable(pieces, func(i, j int) bool {
+		if pieces[i].X+pieces[i].Y != pieces[j].X+pieces[j].Y {
+			return pieces[i].X+pieces[i].Y < pieces[j].X+pieces[j].Y
+		}
+		return pieces[i].Z < pieces[j].Z
+	})
+
+	if err := checkCanvas(bounds, timing.count); err != nil {
+		return nil, err
+	}
+	frames := make([]*image.NRGBA, timing.count)
+	offset := bounds.Min
+	for i := range frames {
+		scene := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		for _, tile := range tiles {
+			drawFloorTile(scene, tile.Sub(offset), *floor, thickness)
+		}
+		for _, p := range pieces {
+			frame := p.frames[i]
+			draw.Draw(scene, frame.Bounds().Add(p.at.Sub(offset)), frame, image.Point{}, draw.Over)
+		}
+		frames[i] = scene
+	}
+	frames = style.apply(frames)
+
+	os.MkdirAll("../static", 0755)
+	base := ws.renderPrefix() + fmt.Sprintf("scene_s%d_%s", req.Size, key)
+	output := &RenderOutput{Format: req.Format, Warnings: checks.warnings}
+	if err := writeRenderFrames(output, frames, base, timing); err != nil {
+		return nil, err
+	}
+	renderCache.Add(key, output, owners...)
+	return output, nil
+}
+
+// renderScene renders several stored furni placed on tiles into one image
+func renderScene(c *gin.Context) {
+	ws := requestWorkspace(c)
+	if ws == nil {
+		return
+	}
+
+	var req SceneRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		log.Printf("[ERROR] renderScene: error binding JSON: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("[DEBUG] renderScene: rendering %d furni in workspace %s", len(req.Furni), ws.ID)
+
+	output, err := renderSceneFile(ws, req)
+	if err != nil {
+		log.Printf("[ERROR] renderScene: %v", err)
+		c.JSON(nitroErrorStatus(err), gin.H{"error": "Error rendering scene: " + err.Error()})
+		return
+	}
+
+	response := renderResponse(output)
+	delete(response, "direction")
+	delete(response, "state")
+	delete(response, "color")
+	c.JSON(http.StatusOK, response)
+}
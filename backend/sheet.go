@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"xabbo.io/nx/imager"
+	"xabbo.io/nx/res"
+)
+
+// Label metrics of the drawText bitmap font
+const (
+	labelCharWidth  = 8
+	labelCharHeight = 12
+)
+
+// defaultSheetPadding is the space around and between contact sheet cells
+const defaultSheetPadding = 8
+
+// SheetRequest asks for a contact sheet: one row per state and one column
+// per direction, or per direction and color when Colors is given or
+// PerColor is set. Empty lists default to all the values the furni has.
+type SheetRequest struct {
+	Filename   string `json:"filename"`
+	Size       int    `json:"size"`
+	Directions []int  `json:"directions,omitempty"`
+	States     []int  `json:"states,omitempty"`
+	Colors     []int  `json:"colors,omitempty"`
+	PerColor   bool   `json:"per_color,omitempty"`
+	Color      int    `json:"color"`
+	// Background is #rrggbb, #rrggbbaa or transparent (default)
+	Background string `json:"background,omitempty"`
+	Padding    *int   `json:"padding,omitempty"`
+	Labels     *bool  `json:"labels,omitempty"`
+}
+
+// parseHexColor parses #rgb, #rrggbb or #rrggbbaa; "" and transparent
+// give a fully transparent color
+func parseHexColor(s string) (color.RGBA, error) {
+	if s == "" || strings.EqualFold(s, "transparent") {
+		return color.RGBA{}, nil
+	}
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if len(hex) != 8 || err != nil {
+		return color.RGBA{}, fmt.Errorf("invalid color %q", s)
+	}
+	c := color.NRGBA{R: uint8(v >> 24), G: uint8(v >> 16), B: uint8(v >> 8), A: uint8(v)}
+	return color.RGBAModel.Convert(c).(color.RGBA), nil
+}
+
+// renderStill composes one direction, state and color of a library and
+// renders the first frame of its first sequence
+func renderStill(lib res.FurniLibrary, size, direction, state, col int) (image.Image, error) {
+	imgr := imager.NewFurniImager(NewSimpleLibraryManager(lib))
+	anim, err := imgr.Compose(imager.Furni{
+		Identifier: lib.Name(),
+		Size:       size,
+		Direction:  direction,
+		State:      state,
+		Color:      col,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(anim.Layers) == 0 {
+		return nil, fmt.Errorf("no layers in animation for direction %d, state %d", direction, state)
+	}
+
+	var buf bytes.Buffer
+	if err := imager.NewEncoderPNG().EncodeFrame(&buf, anim, 0, 0); err != nil {
+		return nil, err
+	}
+	return png.Decode(&buf)
+}
+
+// sheetCell is one rendered cell of a contact sheet
+type sheetCell struct {
+	direction, state, color int
+	img                     image.Image
+}
+
+// renderContactSheet renders a grid of the furni: states down, directions
+// (and colors) across. Cells that fail are left empty and reported.
+func renderContactSheet(ws *Workspace, lib res.FurniLibrary, info *FurniInfo, req SheetRequest, key string) (string, []BatchRenderResult, error) {
+	background, err := parseHexColor(req.Background)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %v", ErrInvalidRender, err)
+	}
+	padding := defaultSheetPadding
+	if req.Padding != nil {
+		padding = *req.Padding
+	}
+	if padding < 0 || padding > maxRenderPadding {
+		return "", nil, fmt.Errorf("%w: padding must be between 0 and %d", ErrInvalidRender, maxRenderPadding)
+	}
+	labels := req.Labels == nil || *req.Labels
+
+	size := req.Size
+	if size == 0 {
+		size = info.Size
+	}
+	directions, states, colors := req.Directions, req.States, req.Colors
+	if len(directions) == 0 {
+		directions = info.Directions
+	}
+	if len(states) == 0 {
+		states = info.States
+	}
+	if len(colors) == 0 {
+		colors = []int{req.Color}
+		if req.PerColor {
+			colors = info.Colors
+		}
+	}
+	directions, states, colors = uniqueInts(directions), uniqueInts(states), uniqueInts(colors)
+	perColor := len(colors) > 1
+	if len(directions)*len(states)*len(colors) > maxBatchRenders {
+		return "", nil, fmt.Errorf("%w: too many cells, the limit is %d", ErrInvalidRender, maxBatchRenders)
+	}
+
+	// Render every cell first; the grid is sized after the largest one
+	var cells [][]sheetCell
+	var failures []BatchRenderResult
+	cellW, cellH := 1, 1
+	for _, state := range states {
+		row := []sheetCell{}
+		for _, direction := range directions {
+			for _, col := range colors {
+				cell := sheetCell{direction: direction, state: state, color: col}
+				cell.img, err = renderStill(lib, size, direction, state, col)
+				if err != nil {
+					failures = append(failures, BatchRenderResult{Direction: direction, State: state, Color: col, Error: err.Error()})
+				} else {
+					cellW = max(cellW, cell.img.Bounds().Dx())
+					cellH = max(cellH, cell.img.Bounds().Dy())
+				}
+				row = append(row, cell)
+			}
+		}
+		cells = append(cells, row)
+	}
+
+	columnLabel := func(cell sheetCell) string {
+		if perColor {
+			return fmt.Sprintf("D%d C%d", cell.direction, cell.color)
+		}
+		return fmt.Sprintf("D%d", cell.direction)
+	}
+	rowLabel := func(state int) string { return fmt.Sprintf("ST%d", state) }
+
+	// Labels take a column on the left and a row on top
+	labelW, labelH := 0, 0
+	if labels {
+		for _, state := range states {
+			labelW = max(labelW, len(rowLabel(state))*labelCharWidth+padding)
+		}
+		for _, cell := range cells[0] {
+			cellW = max(cellW, len(columnLabel(cell))*labelCharWidth)
+		}
+		labelH = labelCharHeight + padding
+	}
+
+	columns := len(cells[0])
+	width := padding + labelW + columns*(cellW+padding)
+	height := padding + labelH + len(cells)*(cellH+padding)
+	sheet := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(sheet, sheet.Bounds(), &image.Uniform{background}, image.Point{}, draw.Src)
+
+	labelColor := color.RGBA{40, 40, 40, 255}
+	if background.A > 0 && int(background.R)+int(background.G)+int(background.B) < 3*128 {
+		labelColor = color.RGBA{230, 230, 230, 255}
+	}
+
+	for r, row := range cells {
+		y := padding + labelH + r*(cellH+padding)
+		if labels {
+			drawText(sheet, padding, y+(cellH-labelCharHeight)/2, rowLabel(row[0].state), labelColor)
+		}
+		for col, cell := range row {
+			x := padding + labelW + col*(cellW+padding)
+			if labels && r == 0 {
+				drawText(sheet, x, padding, columnLabel(cell), labelColor)
+			}
+			if cell.img == nil {
+				continue
+			}
+			// Center the frame in its cell
+			b := cell.img.Bounds()
+			at := image.Pt(x+(cellW-b.Dx())/2, y+(cellH-b.Dy())/2)
+			draw.Draw(sheet, image.Rectangle{at, at.Add(b.Size())}, cell.img, b.Min, draw.Over)
+		}
+	}
+
+	libName := lib.Name()
+	if libName == "" {
+		libName = strings.TrimSuffix(req.Filename, ".nitro")
+	}
+	outputFilename := ws.renderPrefix() + fmt.Sprintf("%s_s%d_sheet_%s.png", libName, size, key)
+	os.MkdirAll("../static", 0755)
+	err = writeStatic(outputFilename, func(w io.Writer) error {
+		return png.Encode(w, sheet)
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return outputFilename, failures, nil
+}
+
+// renderSheet renders a contact sheet PNG of a furni
+func renderSheet(c *gin.Context) {
+	ws := requestWorkspace(c)
+	if ws == nil {
+		return
+	}
+
+	var req SheetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		log.Printf("[ERROR] renderSheet: error binding JSON: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	filename := req.Filename
+	if !strings.HasSuffix(filename, ".nitro") {
+		filename += ".nitro"
+	}
+	data, err := ws.Store.Get(filename)
+	if err != nil {
+		c.JSON(nitroErrorStatus(err), gin.H{"error": "Error loading .nitro file: " + err.Error()})
+		return
+	}
+	info, err := processNitroData(filename, data)
+	if err != nil {
+		c.JSON(nitroErrorStatus(err), gin.H{"error": "Error processing file: " + err.Error()})
+		return
+	}
+	key := renderKey(ws, data, req)
+	if output, ok := renderCache.Get(key); ok {
+		c.JSON(http.StatusOK, gin.H{"sheet_url": "/static/" + output.Filename})
+		return
+	}
+	lib, err := loadFurniLibrary(data)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error loading furni library: " + err.Error()})
+		return
+	}
+
+	sheetPath, failures, err := renderContactSheet(ws, lib, info, req, key)
+	if err != nil {
+		log.Printf("[ERROR] renderSheet: %v", err)
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrInvalidRender) {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"error": "Error rendering contact sheet: " + err.Error()})
+		return
+	}
+
+	// Sheets with failed cells are rendered again next time
+	response := gin.H{"sheet_url": "/static/" + sheetPath}
+	if len(failures) > 0 {
+		response["errors"] = failures
+	} else {
+		renderCache.Add(key, &RenderOutput{Filename: sheetPath, Format: formatPNG}, renderOwner(ws, filename))
+	}
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Store keeps files by name in a flat namespace. Names are validated by
+// every implementation, so callers can pass user input straight through.
+type Store interface {
+	Get(name string) ([]byte, error)
+	Put(name string, data []byte) error
+	List() ([]StoreEntry, error)
+	Delete(name string) error
+	Stat(name string) (StoreEntry, error)
+}
+
+// BackupStore is implemented by stores that keep previous versions on Put
+type BackupStore interface {
+	Backups(name string) ([]BackupInfo, error)
+	RestoreBackup(name string, n int) error
+}
+
+// StoreEntry describes a stored file
+type StoreEntry struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// ErrInvalidName is returned for names that could escape the store
+var ErrInvalidName = errors.New("invalid file name")
+
+// checkName rejects anything but a plain file name: no separators, no
+// parent or hidden entries and no control characters
+func checkName(name string) error {
+	if name == "" || len(name) > 255 || strings.HasPrefix(name, ".") ||
+		strings.ContainsAny(name, `/\:`) || filepath.Base(name) != name {
+		return fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("%w: %q", ErrInvalidName, name)
+		}
+	}
+	return nil
+}
+
+// notFound wraps fs.ErrNotExist so callers can test for it with errors.Is
+func notFound(name string) error {
+	return fmt.Errorf("%w: %s", fs.ErrNotExist, name)
+}
+
+// LocalStore keeps files in a directory on disk. Writes are atomic and the
+// previous Keep versions of each file are kept in a .backups directory.
+type LocalStore struct {
+	Dir  string
+	Keep int
+}
+
+func NewLocalStore(dir string, keep int) *LocalStore {
+	return &LocalStore{Dir: dir, Keep: keep}
+}
+
+func (s *LocalStore) path(name string) (string, error) {
+	if err := checkName(name); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.Dir, name), nil
+}
+
+func (s *LocalStore) Get(name string) ([]byte, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, notFound(name)
+	}
+	return data, err
+}
+
+func (s *LocalStore) Put(name string, data []byte) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, s.Keep, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+func (s *LocalStore) List() ([]StoreEntry, error) {
+	dirEntries, err := os.ReadDir(s.Dir)
+	if os.IsNotExist(err) {
+		return []StoreEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []StoreEntry{}
+	for _, entry := range dirEntries {
+		if !entry.Type().IsRegular() || checkName(entry.Name()) != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		entries = append(entries, StoreEntry{Name: entry.Name(), Size: info.Size(), ModTime: info.ModTime()})
+	}
+	return entries, nil
+}
+
+func (s *LocalStore) Delete(name string) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return notFound(name)
+	}
+	if err != nil {
+		return err
+	}
+	return removeBackups(path)
+}
+
+func (s *LocalStore) Stat(name string) (StoreEntry, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return StoreEntry{}, err
+	}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) || (err == nil && !info.Mode().IsRegular()) {
+		return StoreEntry{}, notFound(name)
+	}
+	if err != nil {
+		return StoreEntry{}, err
+	}
+	return StoreEntry{Name: name, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *LocalStore) Backups(name string) ([]BackupInfo, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return listBackups(path)
+}
+
+func (s *LocalStore) RestoreBackup(name string, n int) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	err = restoreBackup(path, n, s.Keep)
+	if os.IsNotExist(err) {
+		return notFound(fmt.Sprintf("%s backup %d", name, n))
+	}
+	return err
+}
+
+// MemoryStore keeps files in memory, for tests and servers that shouldn't write
+// to disk. Like LocalStore it keeps the previous Keep versions of each file.
+type MemoryStore struct {
+	Keep int
+
+	mu      sync.RWMutex
+	files   map[string]memoryFile
+	history map[string][]memoryFile
+}
+
+type memoryFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+func NewMemoryStore(keep int) *MemoryStore {
+	return &MemoryStore{
+		Keep:    keep,
+		files:   make(map[string]memoryFile),
+		history: make(map[string][]memoryFile),
+	}
+}
+
+func (s *MemoryStore) Get(name string) ([]byte, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	file, ok := s.files[name]
+	if !ok {
+		return nil, notFound(name)
+	}
+	return bytes.Clone(file.data), nil
+}
+
+func (s *MemoryStore) Put(name string, data []byte) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.put(name, bytes.Clone(data))
+	return nil
+}
+
+func (s *MemoryStore) put(name string, data []byte) {
+	if old, ok := s.files[name]; ok && s.Keep > 0 {
+		versions := append([]memoryFile{old}, s.history[name]...)
+		if len(versions) > s.Keep {
+			versions = versions[:s.Keep]
+		}
+		s.history[name] = versions
+	}
+	s.files[name] = memoryFile{data: data, modTime: time.Now()}
+}
+
+func (s *MemoryStore) List() ([]StoreEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entries := make([]StoreEntry, 0, len(s.files))
+	for name, file := range s.files {
+		entries = append(entries, StoreEntry{Name: name, Size: int64(len(file.data)), ModTime: file.modTime})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
+
+func (s *MemoryStore) Delete(name string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.files[name]; !ok {
+		return notFound(name)
+	}
+	delete(s.files, name)
+	delete(s.history, name)
+	return nil
+}
+
+func (s *MemoryStore) Stat(name string) (StoreEntry, error) {
+	if err := checkName(name); err != nil {
+		return StoreEntry{}, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	file, ok := s.files[name]
+	if !ok {
+		return StoreEntry{}, notFound(name)
+	}
+	return StoreEntry{Name: name, Size: int64(len(file.data)), ModTime: file.modTime}, nil
+}
+
+func (s *MemoryStore) Backups(name string) ([]BackupInfo, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	backups := []BackupInfo{}
+	for i, file := range s.history[name] {
+		backups = append(backups, BackupInfo{Index: i + 1, Size: int64(len(file.data)), ModTime: file.modTime})
+	}
+	return backups, nil
+}
+
+func (s *MemoryStore) RestoreBackup(name string, n int) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	versions := s.history[name]
+	if n < 1 || n > len(versions) {
+		return notFound(fmt.Sprintf("%s backup %d", name, n))
+	}
+	if err := checkBackup(versions[n-1].data, n); err != nil {
+		return err
+	}
+	s.put(name, versions[n-1].data)
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"testing"
+)
+
+// testStores returns a LocalStore and a MemoryStore keeping keep backups
+func testStores(t *testing.T, keep int) map[string]Store {
+	return map[string]Store{
+		"local":  NewLocalStore(t.TempDir(), keep),
+		"memory": NewMemoryStore(keep),
+	}
+}
+
+func TestCheckName(t *testing.T) {
+	valid := []string{"chair.nitro", "chair_2.nitro", "ÿ furni.nitro", "a..b.nitro"}
+	invalid := []string{"", ".", "..", "../chair.nitro", "a/b.nitro", `a\b.nitro`, "c:chair.nitro",
+		".hidden", ".backups", "chair\x00.nitro", "chair\n.nitro", string(bytes.Repeat([]byte("a"), 256))}
+	for _, name := range valid {
+		if err := checkName(name); err != nil {
+			t.Errorf("checkName(%q) = %v", name, err)
+		}
+	}
+	for _, name := range invalid {
+		if err := checkName(name); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("checkName(%q) = %v, want ErrInvalidName", name, err)
+		}
+	}
+}
+
+func TestStoreFiles(t *testing.T) {
+	for kind, store := range testStores(t, 0) {
+		t.Run(kind, func(t *testing.T) {
+			if _, err := store.Get("chair.nitro"); !errors.Is(err, fs.ErrNotExist) {
+				t.Fatalf("Get missing = %v", err)
+			}
+			if err := store.Put("chair.nitro", []byte("chair")); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Put("table.nitro", []byte("table!")); err != nil {
+				t.Fatal(err)
+			}
+			if data, err := store.Get("chair.nitro"); err != nil || string(data) != "chair" {
+				t.Fatalf("Get = %q, %v", data, err)
+			}
+			if entry, err := store.Stat("table.nitro"); err != nil || entry.Name != "table.nitro" || entry.Size != 6 {
+				t.Fatalf("Stat = %+v, %v", entry, err)
+			}
+			entries, err := store.List()
+			if err != nil || len(entries) != 2 {
+				t.Fatalf("List = %+v, %v", entries, err)
+			}
+
+			if err := store.Delete("chair.nitro"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.Stat("chair.nitro"); !errors.Is(err, fs.ErrNotExist) {
+				t.Fatalf("Stat deleted = %v", err)
+			}
+			if err := store.Delete("chair.nitro"); !errors.Is(err, fs.ErrNotExist) {
+				t.Fatalf("Delete deleted = %v", err)
+			}
+
+			// Every operation rejects names that could escape the store
+			for _, name := range []string{"../table.nitro", "a/table.nitro", ".."} {
+				if _, err := store.Get(name); !errors.Is(err, ErrInvalidName) {
+					t.Errorf("Get(%q) = %v", name, err)
+				}
+				if err := store.Put(name, nil); !errors.Is(err, ErrInvalidName) {
+					t.Errorf("Put(%q) = %v", name, err)
+				}
+				if _, err := store.Stat(name); !errors.Is(err, ErrInvalidName) {
+					t.Errorf("Stat(%q) = %v", name, err)
+				}
+				if err := store.Delete(name); !errors.Is(err, ErrInvalidName) {
+					t.Errorf("Delete(%q) = %v", name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestStoreBackups(t *testing.T) {
+	versions := make([][]byte, 4)
+	for i := range versions {
+		versions[i] = testArchive(t, "chair", fmt.Sprintf(`{"name":"chair","version":%d}`, i), testSheet(1, 1))
+	}
+	for kind, store := range testStores(t, 2) {
+		t.Run(kind, func(t *testing.T) {
+			backups := store.(BackupStore)
+			for _, data := range versions {
+				if err := store.Put("chair.nitro", data); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// The two versions before the current one, newest first
+			list, err := backups.Backups("chair.nitro")
+			if err != nil || len(list) != 2 || list[0].Index != 1 || list[0].Size != int64(len(versions[2])) {
+				t.Fatalf("Backups = %+v, %v", list, err)
+			}
+
+			if err := backups.RestoreBackup("chair.nitro", 2); err != nil {
+				t.Fatal(err)
+			}
+			if data, _ := store.Get("chair.nitro"); !bytes.Equal(data, versions[1]) {
+				t.Fatal("restore didn't bring back version 1")
+			}
+			// Restoring keeps what it replaced
+			if list, _ := backups.Backups("chair.nitro"); len(list) != 2 || list[0].Size != int64(len(versions[3])) {
+				t.Fatalf("Backups after restore = %+v", list)
+			}
+			if err := backups.RestoreBackup("chair.nitro", 3); !errors.Is(err, fs.ErrNotExist) {
+				t.Fatalf("RestoreBackup past the backups = %v", err)
+			}
+
+			// Backups that aren't archives aren't restored
+			store.Put("chair.nitro", []byte("not a nitro file"))
+			store.Put("chair.nitro", versions[0])
+			if err := backups.RestoreBackup("chair.nitro", 1); err == nil {
+				t.Fatal("restored a backup that isn't a .nitro file")
+			}
+			if data, _ := store.Get("chair.nitro"); !bytes.Equal(data, versions[0]) {
+				t.Fatal("failed restore changed the file")
+			}
+
+			if err := store.Delete("chair.nitro"); err != nil {
+				t.Fatal(err)
+			}
+			if list, _ := backups.Backups("chair.nitro"); len(list) != 0 {
+				t.Fatalf("Backups after delete = %+v", list)
+			}
+		})
+	}
+}
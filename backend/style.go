@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"strings"
+)
+
+// Limits of the presentation options of RenderRequest
+const (
+	maxRenderScale   = 8
+	maxRenderPadding = 256
+)
+
+// Colors of the default room floor tile: top face, left and right sides
+var (
+	floorTopColor   = color.RGBA{152, 152, 101, 255}
+	floorLeftColor  = color.RGBA{110, 110, 73, 255}
+	floorRightColor = color.RGBA{129, 129, 86, 255}
+)
+
+// renderStyle is how rendered frames are presented: a background color, an
+// optional floor tile under the furni, an integer zoom and padding around it
+type renderStyle struct {
+	background color.RGBA
+	floor      *color.RGBA // top face of the floor tile, nil for none
+	tileWidth  int
+	scale      int
+	padding    int
+}
+
+// parseRenderStyle checks the presentation options of a render at size.
+// Background is a color (#rgb, #rrggbb, #rrggbbaa, transparent) or floor,
+// optionally with the color of the tile: floor:#rrggbb.
+func parseRenderStyle(req RenderRequest, size int) (renderStyle, error) {
+	style := renderStyle{scale: req.Scale, padding: req.Padding, tileWidth: size}
+	if style.scale == 0 {
+		style.scale = 1
+	}
+	if style.scale < 1 || style.scale > maxRenderScale {
+		return style, fmt.Errorf("%w: scale must be between 1 and %d", ErrInvalidRender, maxRenderScale)
+	}
+	if style.padding < 0 || style.padding > maxRenderPadding {
+		return style, fmt.Errorf("%w: padding must be between 0 and %d", ErrInvalidRender, maxRenderPadding)
+	}
+
+	background := strings.TrimSpace(req.Background)
+	if name, tile, ok := strings.Cut(background, ":"); strings.EqualFold(name, "floor") {
+		floor := floorTopColor
+		if ok {
+			c, err := parseHexColor(tile)
+			if err != nil {
+				return style, fmt.Errorf("%w: background: %v", ErrInvalidRender, err)
+			}
+			floor = c
+		}
+		style.floor = &floor
+		return style, nil
+	}
+	c, err := parseHexColor(background)
+	if err != nil {
+		return style, fmt.Errorf("%w: background: %v", ErrInvalidRender, err)
+	}
+	style.background = c
+	return style, nil
+}
+
+// plain reports whether the style leaves frames as nx renders them
+func (s renderStyle) plain() bool {
+	return s.background.A == 0 && s.floor == nil && s.scale == 1 && s.padding == 0
+}
+
+// apply presents frames of the same size in the style, returning new frames
+// that all share one size again
+func (s renderStyle) apply(frames []*image.NRGBA) []*image.NRGBA {
+	if s.plain() || len(frames) == 0 {
+		return frames
+	}
+	frameW, frameH := frames[0].Bounds().Dx(), frames[0].Bounds().Dy()
+
+	// The floor tile goes under the furni, its bottom corner at the bottom of
+	// the frame. Frames don't keep the registration point, so this is where
+	// the footprint of a 1x1 furni usually ends up.
+	tileW, tileH, thickness := s.tileWidth, s.tileWidth/2, 0
+	innerW, innerH := frameW, frameH
+	if s.floor != nil {
+		thickness = s.tileWidth / 8
+		innerW = max(frameW, tileW)
+		innerH = max(frameH, tileH) + thickness
+	}
+	at := image.Pt((innerW-frameW)/2, innerH-thickness-frameH)
+
+	styled := make([]*image.NRGBA, len(frames))
+	for i, frame := range frames {
+		inner := image.NewNRGBA(image.Rect(0, 0, innerW, innerH))
+		if s.floor != nil {
+			tile := image.Rect(0, 0, tileW, tileH+thickness).Add(image.Pt((innerW-tileW)/2, innerH-tileH-thickness))
+			drawFloorTile(inner, tile, *s.floor, thickness)
+		}
+		draw.Draw(inner, frame.Bounds().Add(at), frame, image.Point{}, draw.Over)
+
+		out := image.NewNRGBA(image.Rect(0, 0, innerW*s.scale+2*s.padding, innerH*s.scale+2*s.padding))
+		draw.Draw(out, out.Bounds(), &image.Uniform{s.background}, image.Point{}, draw.Src)
+		scaled := scaleNearest(inner, s.scale)
+		draw.Draw(out, scaled.Bounds().Add(image.Pt(s.padding, s.padding)), scaled, image.Point{}, draw.Over)
+		styled[i] = out
+	}
+	return styled
+}
+
+// drawFloorTile draws an isometric floor tile filling rect: a diamond top
+// face with its two sides thickness pixels deep below it
+func drawFloorTile(dst draw.Image, rect image.Rectangle, top color.RGBA, thickness int) {
+	w, h := rect.Dx(), rect.Dy()-thickness
+	if w <= 0 || h <= 0 {
+		return
+	}
+	left, right := floorLeftColor, floorRightColor
+	if top != floorTopColor {
+		left, right = shade(top, 72), shade(top, 85)
+	}
+	onTop := func(x, y int) bool {
+		fx := (float64(x) + 0.5 - float64(w)/2) / (float64(w) / 2)
+		fy := (float64(y) + 0.5 - float64(h)/2) / (float64(h) / 2)
+		if fx < 0 {
+			fx = -fx
+		}
+		if fy < 0 {
+			fy = -fy
+		}
+		return fx+fy <= 1
+	}
+
+	for y := 0; y < h+thickness; y++ {
+		for x := 0; x < w; x++ {
+			var c color.RGBA
+			if onTop(x, y) {
+				c = top
+			} else {
+				for k := 1; k <= thickness; k++ {
+					if y-k < h && onTop(x, y-k) {
+						if x < w/2 {
+							c = left
+						} else {
+							c = right
+						}
+						break
+					}
+				}
+			}
+			if c.A > 0 {
+				dst.Set(rect.Min.X+x, rect.Min.Y+y, c)
+			}
+		}
+	}
+}
+
+// shade darkens a color to percent of its brightness
+func shade(c color.RGBA, percent int) color.RGBA {
+	return color.RGBA{
+		R: uint8(int(c.R) * percent / 100),
+		G: uint8(int(c.G) * percent / 100),
+		B: uint8(int(c.B) * percent / 100),
+		A: c.A,
+	}
+}
+
+// scaleNearest enlarges an image by an integer factor without smoothing,
+// keeping pixel art sharp
+func scaleNearest(src *image.NRGBA, scale int) *image.NRGBA {
+	if scale == 1 {
+		return src
+	}
+	b := src.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx()*scale, b.Dy()*scale))
+	for y := 0; y < b.Dy(); y++ {
+		start := src.PixOffset(b.Min.X, b.Min.Y+y)
+		srcRow := src.Pix[start : start+b.Dx()*4]
+		for x := 0; x < b.Dx(); x++ {
+			px := srcRow[x*4 : x*4+4]
+			for dy := 0; dy < scale; dy++ {
+				row := dst.Pix[(y*scale+dy)*dst.Stride:]
+				for dx := 0; dx < scale; dx++ {
+					copy(row[(x*scale+dx)*4:], px)
+				}
+			}
+		}
+	}
+	return dst
+}
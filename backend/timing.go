@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxAnimationFrames caps the frames of one animated render
+const maxAnimationFrames = 1024
+
+// Limits of the timing overrides of RenderRequest
+const (
+	maxRenderFPS   = 100
+	minFrameDelay  = 10
+	maxFrameDelay  = 10000
+	maxRenderLoops = 1000
+)
+
+// FrameCount is how many frames a render has. FrameCountAuto renders one
+// full loop of the animation, so it can repeat without a visible jump.
+type FrameCount int
+
+// FrameCountAuto is sent as "auto"
+const FrameCountAuto FrameCount = -1
+
+func (n FrameCount) MarshalJSON() ([]byte, error) {
+	if n == FrameCountAuto {
+		return []byte(`"auto"`), nil
+	}
+	return json.Marshal(int(n))
+}
+
+func (n *FrameCount) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		if !strings.EqualFold(s, "auto") {
+			return fmt.Errorf("frame_count must be a number or \"auto\", not %q", s)
+		}
+		*n = FrameCountAuto
+		return nil
+	}
+	var i int
+	if err := json.Unmarshal(data, &i); err != nil || i < 0 {
+		return fmt.Errorf("frame_count must be a number or \"auto\", not %s", data)
+	}
+	*n = FrameCount(i)
+	return nil
+}
+
+// frameTiming is which frames of an animation a render encodes and how
+// they play
+type frameTiming struct {
+	start   int
+	count   int
+	delayMs int
+	loops   int // times the animation plays, 0 for forever
+}
+
+// parseFrameTiming checks the timing overrides of a render. frameCount is
+// used unless the request asks for a number of frames itself; FrameCountAuto
+// must have been resolved with resolveFrameCount before.
+func parseFrameTiming(req RenderRequest, frameCount int) (frameTiming, error) {
+	timing := frameTiming{start: req.StartFrame, count: frameCount, delayMs: frameDurationMs()}
+	if req.StartFrame < 0 {
+		return timing, fmt.Errorf("%w: start_frame can't be negative", ErrInvalidRender)
+	}
+	switch {
+	case req.FrameCount == FrameCountAuto:
+		return timing, fmt.Errorf("%w: frame_count auto was not resolved", ErrInvalidRender)
+	case req.FrameCount > 0:
+		timing.count = int(req.FrameCount)
+	}
+	if timing.count > maxAnimationFrames {
+		return timing, fmt.Errorf("%w: %d frames, the limit is %d", ErrInvalidRender, timing.count, maxAnimationFrames)
+	}
+
+	switch {
+	case req.DelayMs != 0:
+		if req.DelayMs < minFrameDelay || req.DelayMs > maxFrameDelay {
+			return timing, fmt.Errorf("%w: delay_ms must be between %d and %d", ErrInvalidRender, minFrameDelay, maxFrameDelay)
+		}
+		timing.delayMs = req.DelayMs
+	case req.FPS != 0:
+		if req.FPS < 1 || req.FPS > maxRenderFPS {
+			return timing, fmt.Errorf("%w: fps must be between 1 and %d", ErrInvalidRender, maxRenderFPS)
+		}
+		timing.delayMs = (1000 + req.FPS/2) / req.FPS
+	}
+
+	if req.LoopCount != nil {
+		if *req.LoopCount < 0 || *req.LoopCount > maxRenderLoops {
+			return timing, fmt.Errorf("%w: loop_count must be between 0 (forever) and %d", ErrInvalidRender, maxRenderLoops)
+		}
+		timing.loops = *req.LoopCount
+	}
+	return timing, nil
+}
+
+// plain reports whether the nx GIF encoder can play the frames as they are:
+// from the first frame, at its own rate, forever
+func (t frameTiming) plain() bool {
+	return t.start == 0 && t.delayMs == frameDurationMs() && t.loops == 0
+}
+
+// fps is the frame rate closest to the delay between frames
+func (t frameTiming) fps() int {
+	return (1000 + t.delayMs/2) / t.delayMs
+}
+
+// resolveFrameCount replaces FrameCountAuto in req by the loop length of
+// the requested size and state
+func resolveFrameCount(furni *NitroFurni, req *RenderRequest) error {
+	if req.FrameCount != FrameCountAuto {
+		return nil
+	}
+	length := furni.LoopLength(req.Size, req.State)
+	if length > maxAnimationFrames {
+		return fmt.Errorf("%w: the animation loops after %d frames, the limit is %d", ErrInvalidRender, length, maxAnimationFrames)
+	}
+	req.FrameCount = FrameCount(length)
+	return nil
+}
+
+// readNitroFurni parses the furni JSON in the contents of a .nitro file
+func readNitroFurni(data []byte) (*NitroFurni, error) {
+	archive, err := parseNitroArchive(data)
+	if err != nil {
+		return nil, err
+	}
+	furni := findNitroFurni(archive)
+	if furni == nil {
+		return nil, fmt.Errorf("no furni JSON in archive")
+	}
+	return furni, nil
+}
+
+// LoopLength is the number of frames after which every layer of the
+// animation of a state is back at its first frame: the least common
+// multiple of the sequence lengths times their frameRepeat. Lengths past
+// maxAnimationFrames are returned as soon as they are reached.
+func (f *NitroFurni) LoopLength(size, state int) int {
+	length := 1
+	vis := f.visualization(size)
+	if vis == nil {
+		return length
+	}
+	anim, ok := vis.Animations[strconv.Itoa(state)]
+	if !ok {
+		return length
+	}
+	for _, layer := range anim.Layers {
+		repeat := max(1, int(layer.FrameRepeat))
+		for _, seq := range layer.FrameSequences {
+			if len(seq.Frames) == 0 {
+				continue
+			}
+			length = lcm(length, len(seq.Frames)*repeat)
+			if length > maxAnimationFrames {
+				return length
+			}
+		}
+	}
+	return length
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+func lcm(a, b int) int {
+	return a / gcd(a, b) * b
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+
+	"xabbo.io/nx/res"
+)
+
+// visualization returns the visualization of a size, or nil
+func (f *NitroFurni) visualization(size int) *NitroVisualization {
+	for i := range f.Visualizations {
+		if f.Visualizations[i].Size == size {
+			return &f.Visualizations[i]
+		}
+	}
+	return nil
+}
+
+// PlayLength is the number of frames an animation takes to play once: its
+// longest layer, counting frameRepeat and loopCount
+func (f *NitroFurni) PlayLength(size, id int) int {
+	length := 1
+	vis := f.visualization(size)
+	if vis == nil {
+		return length
+	}
+	anim, ok := vis.Animations[strconv.Itoa(id)]
+	if !ok {
+		return length
+	}
+	for _, layer := range anim.Layers {
+		repeat := max(1, int(layer.FrameRepeat)) * max(1, int(layer.LoopCount))
+		for _, seq := range layer.FrameSequences {
+			length = max(length, len(seq.Frames)*repeat)
+		}
+	}
+	return length
+}
+
+// TransitionChain returns the animations the client plays when a furni
+// switches from state from to state to, in order: the transitions leading
+// to to, then to itself. A transition is an animation whose transitionTo
+// names the animation played after it. When from is itself part of a chain
+// leading to to, the rest of that chain is played; otherwise the chain is
+// followed back from to through the lowest animation IDs.
+func (f *NitroFurni) TransitionChain(size, from, to int) ([]int, error) {
+	vis := f.visualization(size)
+	if vis == nil {
+		return nil, fmt.Errorf("%w: no visualization for size: %d", ErrInvalidRender, size)
+	}
+
+	leadsTo := make(map[int][]int)
+	for key, anim := range vis.Animations {
+		id, err := strconv.Atoi(key)
+		if err != nil || anim.TransitionTo == nil {
+			continue
+		}
+		leadsTo[*anim.TransitionTo] = append(leadsTo[*anim.TransitionTo], id)
+	}
+	if len(leadsTo[to]) == 0 {
+		return nil, fmt.Errorf("%w: no animation transitions to state %d", ErrInvalidRender, to)
+	}
+	for _, ids := range leadsTo {
+		sort.Ints(ids)
+	}
+
+	// Walk back from to, breadth first, remembering where each animation leads
+	next := map[int]int{}
+	queue := []int{to}
+	_, found := next[from]
+	for len(queue) > 0 && !found {
+		target := queue[0]
+		queue = queue[1:]
+		for _, id := range leadsTo[target] {
+			if _, ok := next[id]; !ok && id != to {
+				next[id] = target
+				queue = append(queue, id)
+			}
+		}
+		_, found = next[from]
+	}
+
+	var chain []int
+	if found {
+		// The furni is already showing from
+		for id := next[from]; id != to; id = next[id] {
+			chain = append(chain, id)
+		}
+	} else {
+		seen := map[int]bool{to: true}
+		for id := leadsTo[to][0]; !seen[id]; {
+			seen[id] = true
+			chain = append([]int{id}, chain...)
+			if len(leadsTo[id]) == 0 {
+				break
+			}
+			id = leadsTo[id][0]
+		}
+	}
+	return append(chain, to), nil
+}
+
+// frameSegment is frames rendered from one animation, with where their
+// top-left corner is relative to the registration point
+type frameSegment struct {
+	frames []*image.NRGBA
+	origin image.Point
+}
+
+// joinFrames puts frames rendered separately on canvases of one size, each
+// segment at its place relative to the registration point, so parts of the
+// furni that don't move stay put across the joins
+func joinFrames(segments []frameSegment) ([]*image.NRGBA, error) {
+	var bounds image.Rectangle
+	count := 0
+	for _, s := range segments {
+		for _, frame := range s.frames {
+			bounds = bounds.Union(frame.Bounds().Sub(frame.Bounds().Min).Add(s.origin))
+			count++
+		}
+	}
+	if bounds.Empty() {
+		bounds = image.Rect(0, 0, 1, 1)
+	}
+	if err := checkCanvas(bounds, count); err != nil {
+		return nil, err
+	}
+
+	var joined []*image.NRGBA
+	for _, s := range segments {
+		for _, frame := range s.frames {
+			b := frame.Bounds()
+			canvas := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+			draw.Draw(canvas, b.Sub(b.Min).Add(s.origin.Sub(bounds.Min)), frame, b.Min, draw.Src)
+			joined = append(joined, canvas)
+		}
+	}
+	return joined, nil
+}
+
+// renderTransition renders the switch of a furni from req.FromState to
+// req.State as one animation: every transition played once, then the loop
+// of the target state. The frame range and count of req apply to that loop,
+// which defaults to one full loop of every layer.
+func renderTransition(ws *Workspace, lib res.FurniLibrary, furni *NitroFurni, req RenderRequest, key string) (*RenderOutput, error) {
+	format, err := renderFormat(req.Format)
+	if err != nil {
+		return nil, err
+	}
+	direction, err := renderDirection(lib, req.Size, req.Direction)
+	if err != nil {
+		return nil, err
+	}
+	style, err := parseRenderStyle(req, req.Size)
+	if err != nil {
+		return nil, err
+	}
+	checks := &renderChecks{strict: req.Strict}
+	if err := checkRender(furni, req, direction, req.State, checks); err != nil {
+		return nil, err
+	}
+	chain, err := furni.TransitionChain(req.Size, *req.FromState, req.State)
+	if err != nil {
+		return nil, err
+	}
+	timing, err := parseFrameTiming(req, furni.LoopLength(req.Size, req.State))
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[DEBUG] renderTransition: from state %d to %d plays animations %v", *req.FromState, req.State, chain)
+
+	var segments []frameSegment
+	total := 0
+	for i, id := range chain {
+		start, count := 0, furni.PlayLength(req.Size, id)
+		if i == len(chain)-1 {
+			start, count = timing.start, timing.count
+		}
+		total += count
+		if total > maxAnimationFrames {
+			return nil, fmt.Errorf("%w: the transition takes more than %d frames", ErrInvalidRender, maxAnimationFrames)
+		}
+
+		anim, err := composeFurni(lib, req, direction, id)
+		if err != nil {
+			return nil, err
+		}
+		frames, err := renderFrames(anim, 0, start, count)
+		if err != nil {
+			return nil, err
+		}
+		// The frames are cropped to the animation, its origin being the
+		// registration point
+		segments = append(segments, frameSegment{frames: frames, origin: anim.Bounds(0).Min})
+	}
+	joined, err := joinFrames(segments)
+	if err != nil {
+		return nil, err
+	}
+	frames := style.apply(joined)
+
+	base := renderBaseName(ws, lib, req, direction, fmt.Sprintf("st%d-%d", *req.FromState, req.State), key)
+	os.MkdirAll("../static", 0755)
+
+	output := &RenderOutput{Format: format, Direction: direction, State: req.State, Color: req.Color, Warnings: checks.warnings}
+	if err := writeRenderFrames(output, frames, base, timing); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ValidationError is a problem found in a furni JSON, at a JSON pointer
+type ValidationError struct {
+	Pointer string `json:"pointer"`
+	Message string `json:"message"`
+}
+
+func (e ValidationError) Error() string {
+	return e.Pointer + ": " + e.Message
+}
+
+// furniRule constrains the value at a pointer pattern of furniRules
+type furniRule struct {
+	Required  bool
+	NotEmpty  bool     // strings
+	Min, Max  *float64 // numbers
+	IndexKeys bool     // objects whose keys are layer, direction or frame ids
+}
+
+func between(min, max float64) furniRule {
+	return furniRule{Min: &min, Max: &max}
+}
+
+func atLeast(min float64) furniRule {
+	return furniRule{Min: &min}
+}
+
+func (r furniRule) require() furniRule {
+	r.Required = true
+	return r
+}
+
+// furniRules adds to the types of NitroFurni what the client relies on.
+// Patterns are JSON pointers where * stands for any key or index.
+var furniRules = map[string]furniRule{
+	"/name":              {Required: true, NotEmpty: true},
+	"/logicType":         {Required: true, NotEmpty: true},
+	"/visualizationType": {Required: true, NotEmpty: true},
+	"/assets":            {Required: true},
+	"/visualizations":    {Required: true},
+	"/spritesheet":       {Required: true},
+
+	"/logic/model/directions/*": atLeast(0),
+	"/palettes/*/rgb/*/*":       between(0, 255),
+
+	"/visualizations/*/size":                                                    atLeast(1).require(),
+	"/visualizations/*/layerCount":                                              between(0, 26).require(),
+	"/visualizations/*/angle":                                                   between(0, 360),
+	"/visualizations/*/layers":                                                  {IndexKeys: true},
+	"/visualizations/*/layers/*/alpha":                                          between(0, 255),
+	"/visualizations/*/directions":                                              {IndexKeys: true},
+	"/visualizations/*/directions/*/layers":                                     {IndexKeys: true},
+	"/visualizations/*/directions/*/layers/*/alpha":                             between(0, 255),
+	"/visualizations/*/colors":                                                  {IndexKeys: true},
+	"/visualizations/*/colors/*/layers":                                         {IndexKeys: true},
+	"/visualizations/*/animations":                                              {IndexKeys: true},
+	"/visualizations/*/animations/*/transitionTo":                               atLeast(0),
+	"/visualizations/*/animations/*/transitionFrom":                             atLeast(0),
+	"/visualizations/*/animations/*/layers":                                     {IndexKeys: true},
+	"/visualizations/*/animations/*/layers/*/loopCount":                         atLeast(0),
+	"/visualizations/*/animations/*/layers/*/frameRepeat":                       atLeast(0),
+	"/visualizations/*/animations/*/layers/*/frameSequences":                    {IndexKeys: true},
+	"/visualizations/*/animations/*/layers/*/frameSequences/*/frames":           {IndexKeys: true},
+	"/visualizations/*/animations/*/layers/*/frameSequences/*/frames/*/id":      atLeast(0),
+	"/visualizations/*/animations/*/layers/*/frameSequences/*/frames/*/offsets": {IndexKeys: true},
+
+	"/spritesheet/frames":                {Required: true},
+	"/spritesheet/meta":                  {Required: true},
+	"/spritesheet/meta/image":            {Required: true, NotEmpty: true},
+	"/spritesheet/frames/*/frame":        {Required: true},
+	"/spritesheet/frames/*/frame/x":      atLeast(0),
+	"/spritesheet/frames/*/frame/y":      atLeast(0),
+	"/spritesheet/frames/*/frame/w":      atLeast(0),
+	"/spritesheet/frames/*/frame/h":      atLeast(0),
+	"/spritesheet/frames/*/sourceSize/w": atLeast(0),
+	"/spritesheet/frames/*/sourceSize/h": atLeast(0),
+}
+
+// pointerEscaper escapes a key for a JSON pointer (RFC 6901)
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// ValidateFurniJSON checks a furni JSON against NitroFurni and furniRules.
+// Keys the model doesn't know are allowed. It only returns an error for data
+// that isn't JSON.
+func ValidateFurniJSON(data []byte) ([]ValidationError, error) {
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	v := &furniValidator{errors: []ValidationError{}}
+	v.walk(data, reflect.TypeOf(NitroFurni{}), "", "")
+	return v.errors, nil
+}
+
+type furniValidator struct {
+	errors []ValidationError
+}
+
+func (v *furniValidator) fail(pointer, format string, args ...interface{}) {
+	v.errors = append(v.errors, ValidationError{Pointer: pointer, Message: fmt.Sprintf(format, args...)})
+}
+
+// walk checks raw against type t. pointer locates raw in the document and
+// pattern is pointer with * for map keys and array indexes.
+func (v *furniValidator) walk(raw json.RawMessage, t reflect.Type, pointer, pattern string) {
+	rule := furniRules[pattern]
+	if string(raw) == "null" && t.Kind() == reflect.Ptr {
+		return
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		keys, values, err := readObject(raw)
+		if err != nil {
+			v.fail(pointer, "must be an object")
+			return
+		}
+		mt := modelFields(t)
+		for _, key := range keys {
+			if i, ok := mt.index[key]; ok {
+				v.walk(values[key], t.Field(i).Type, pointer+"/"+pointerEscaper.Replace(key), pattern+"/"+key)
+			}
+		}
+		for _, name := range mt.names {
+			if _, ok := values[name]; name != "" && !ok && furniRules[pattern+"/"+name].Required {
+				v.fail(pointer+"/"+pointerEscaper.Replace(name), "is required")
+			}
+		}
+
+	case reflect.Map:
+		keys, values, err := readObject(raw)
+		if err != nil {
+			v.fail(pointer, "must be an object")
+			return
+		}
+		for _, key := range keys {
+			at := pointer + "/" + pointerEscaper.Replace(key)
+			if id, err := strconv.Atoi(key); rule.IndexKeys && (err != nil || id < 0) {
+				v.fail(at, "key must be a non-negative integer")
+			}
+			v.walk(values[key], t.Elem(), at, pattern+"/*")
+		}
+
+	case reflect.Slice:
+		var items []json.RawMessage
+		if err := json.Unmarshal(raw, &items); err != nil || items == nil {
+			v.fail(pointer, "must be an array")
+			return
+		}
+		for i, item := range items {
+			v.walk(item, t.Elem(), pointer+"/"+strconv.Itoa(i), pattern+"/*")
+		}
+
+	case reflect.String:
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil || string(raw) == "null" {
+			v.fail(pointer, "must be a string")
+			return
+		}
+		if rule.NotEmpty && s == "" {
+			v.fail(pointer, "must not be empty")
+		}
+
+	case reflect.Bool:
+		if string(raw) != "true" && string(raw) != "false" {
+			v.fail(pointer, "must be a boolean")
+		}
+
+	case reflect.Int, reflect.Float64:
+		kind := "a number"
+		if t.Kind() == reflect.Int {
+			kind = "an integer"
+		}
+		var n interface{}
+		decodeJSONNumbers(raw, &n)
+		number, ok := n.(json.Number)
+		if !ok {
+			v.fail(pointer, "must be %s", kind)
+			return
+		}
+		if _, err := number.Int64(); err != nil && t.Kind() == reflect.Int {
+			v.fail(pointer, "must be %s", kind)
+			return
+		}
+		f, _ := number.Float64()
+		switch {
+		case rule.Min != nil && rule.Max != nil && (f < *rule.Min || f > *rule.Max):
+			v.fail(pointer, "must be %g-%g", *rule.Min, *rule.Max)
+		case rule.Min != nil && rule.Max == nil && f < *rule.Min:
+			v.fail(pointer, "must be at least %g", *rule.Min)
+		}
+	}
+}
+
+// validateJSON checks a furni JSON without saving it
+func validateJSON(c *gin.Context) {
+	data, err := c.GetRawData()
+	if err != nil {
+		log.Printf("[ERROR] validateJSON: error reading JSON content: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Error reading JSON content: " + err.Error()})
+		return
+	}
+
+	problems, err := ValidateFurniJSON(data)
+	if err != nil {
+		log.Printf("[ERROR] validateJSON: invalid JSON: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "JSON inválido: " + err.Error()})
+		return
+	}
+	log.Printf("[DEBUG] validateJSON: %d errors", len(problems))
+	c.JSON(http.StatusOK, gin.H{"valid": len(problems) == 0, "errors": problems})
+}
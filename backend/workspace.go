@@ -0,0 +1,471 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultWorkspaceID is the workspace behind the unscoped /api routes. It
+// keeps its files in ../uploads, where they were before workspaces existed.
+const defaultWorkspaceID = "default"
+
+// workspaceMetaName holds the metadata of a workspace inside its directory.
+// It starts with a dot so the workspace store never lists it.
+const workspaceMetaName = ".workspace.json"
+
+// maxWorkspaceName caps the length of workspace display names
+const maxWorkspaceName = 100
+
+var (
+	// ErrDefaultWorkspace is returned when renaming or deleting the default workspace
+	ErrDefaultWorkspace = errors.New("the default workspace can't be renamed or deleted")
+	// ErrInvalidWorkspaceName is returned for empty or overlong workspace names
+	ErrInvalidWorkspaceName = errors.New("invalid workspace name")
+)
+
+// Workspace groups uploaded furni. Each workspace has its own store and
+// revision history, so names only have to be unique within a workspace.
+type Workspace struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+
+	Store   Store    `json:"-"`
+	History *History `json:"-"`
+
+	infos *infoCache
+	files fileLocks
+}
+
+// fileLocks serializes the writers of each file of a workspace: an edit
+// loads, changes and saves a file while holding its lock
+type fileLocks struct {
+	mu    sync.Mutex
+	locks map[string]*fileLock
+}
+
+type fileLock struct {
+	sync.Mutex
+	users int
+}
+
+// lockFiles locks the named files until the returned func is called. Names
+// are locked in order, so writers of the same files can't deadlock.
+func (ws *Workspace) lockFiles(names ...string) (unlock func()) {
+	names = append([]string(nil), names...)
+	sort.Strings(names)
+	var held []string
+	for i, name := range names {
+		if i > 0 && name == names[i-1] {
+			continue
+		}
+		ws.files.mu.Lock()
+		if ws.files.locks == nil {
+			ws.files.locks = make(map[string]*fileLock)
+		}
+		lock, ok := ws.files.locks[name]
+		if !ok {
+			lock = &fileLock{}
+			ws.files.locks[name] = lock
+		}
+		lock.users++
+		ws.files.mu.Unlock()
+		lock.Lock()
+		held = append(held, name)
+	}
+	return func() {
+		ws.files.mu.Lock()
+		defer ws.files.mu.Unlock()
+		for _, name := range held {
+			lock := ws.files.locks[name]
+			lock.Unlock()
+			if lock.users--; lock.users == 0 {
+				delete(ws.files.locks, name)
+			}
+		}
+	}
+}
+
+// WorkspaceInfo is a workspace as listed by the API
+type WorkspaceInfo struct {
+	*Workspace
+	FurniCount int   `json:"furni_count"`
+	Size       int64 `json:"size"`
+}
+
+// newLocalWorkspace returns a workspace stored in dir, with the same layout
+// as ../uploads: .nitro files at the top, history in .history
+func newLocalWorkspace(dir, id, name string, created time.Time) *Workspace {
+	files := NewLocalStore(dir, maxBackups)
+	return &Workspace{
+		ID:      id,
+		Name:    name,
+		Created: created,
+		Store:   files,
+		History: NewHistory(files, NewLocalStore(filepath.Join(dir, ".history"), 0)),
+		infos:   newInfoCache(),
+	}
+}
+
+// renderPrefix is prepended to the names of GIFs rendered from this
+// workspace, so furni with the same name in two workspaces don't collide in
+// ../static. The default workspace keeps the unprefixed names.
+func (ws *Workspace) renderPrefix() string {
+	if ws.ID == defaultWorkspaceID {
+		return ""
+	}
+	return ws.ID + "_"
+}
+
+// Info counts the furni in the workspace
+func (ws *Workspace) Info() (WorkspaceInfo, error) {
+	info := WorkspaceInfo{Workspace: ws}
+	entries, err := ws.Store.List()
+	if err != nil {
+		return info, err
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name, ".nitro") {
+			info.FurniCount++
+			info.Size += entry.Size
+		}
+	}
+	return info, nil
+}
+
+// Workspaces keeps the workspaces created under Dir, plus the default one
+type Workspaces struct {
+	Dir     string
+	Default *Workspace
+
+	mu   sync.RWMutex
+	byID map[string]*Workspace
+}
+
+func NewWorkspaces(dir string, def *Workspace) *Workspaces {
+	return &Workspaces{Dir: dir, Default: def, byID: make(map[string]*Workspace)}
+}
+
+// Load reads the workspaces found in Dir
+func (w *Workspaces) Load() error {
+	dirEntries, err := os.ReadDir(w.Dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, entry := range dirEntries {
+		if !entry.IsDir() || checkName(entry.Name()) != nil {
+			continue
+		}
+		dir := filepath.Join(w.Dir, entry.Name())
+		data, err := os.ReadFile(filepath.Join(dir, workspaceMetaName))
+		if err != nil {
+			log.Printf("[ERROR] Workspaces.Load: skipping %s: %v", dir, err)
+			continue
+		}
+		var meta Workspace
+		if err := json.Unmarshal(data, &meta); err != nil || meta.ID != entry.Name() {
+			log.Printf("[ERROR] Workspaces.Load: skipping %s: invalid %s", dir, workspaceMetaName)
+			continue
+		}
+		w.byID[meta.ID] = newLocalWorkspace(dir, meta.ID, meta.Name, meta.Created)
+	}
+	return nil
+}
+
+// Get returns the workspace with the given ID
+func (w *Workspaces) Get(id string) (*Workspace, error) {
+	if id == defaultWorkspaceID {
+		return w.Default, nil
+	}
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	ws, ok := w.byID[id]
+	if !ok {
+		return nil, notFound("workspace " + id)
+	}
+	return ws, nil
+}
+
+// List returns the default workspace followed by the others, oldest first
+func (w *Workspaces) List() []*Workspace {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	list := make([]*Workspace, 0, len(w.byID)+1)
+	for _, ws := range w.byID {
+		list = append(list, ws)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].Created.Equal(list[j].Created) {
+			return list[i].Created.Before(list[j].Created)
+		}
+		return list[i].ID < list[j].ID
+	})
+	return append([]*Workspace{w.Default}, list...)
+}
+
+// checkWorkspaceName trims a display name and checks it isn't empty or too long
+func checkWorkspaceName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > maxWorkspaceName {
+		return "", fmt.Errorf("%w: %q", ErrInvalidWorkspaceName, name)
+	}
+	return name, nil
+}
+
+// newWorkspaceID returns a random ID that is also a valid directory name
+func newWorkspaceID() (string, error) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// writeMeta saves the metadata of a workspace in its directory
+func (w *Workspaces) writeMeta(ws *Workspace) error {
+	data, err := json.MarshalIndent(ws, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(w.Dir, ws.ID, workspaceMetaName)
+	return writeFileAtomic(path, 0, func(out io.Writer) error {
+		_, err := out.Write(data)
+		return err
+	})
+}
+
+// Create makes a new, empty workspace
+func (w *Workspaces) Create(name string) (*Workspace, error) {
+	name, err := checkWorkspaceName(name)
+	if err != nil {
+		return nil, err
+	}
+	id, err := newWorkspaceID()
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(w.Dir, id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	ws := newLocalWorkspace(dir, id, name, time.Now().UTC())
+	if err := w.writeMeta(ws); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	w.mu.Lock()
+	w.byID[id] = ws
+	w.mu.Unlock()
+	return ws, nil
+}
+
+// Rename changes the display name of a workspace; its ID stays the same
+func (w *Workspaces) Rename(id, name string) (*Workspace, error) {
+	if id == defaultWorkspaceID {
+		return nil, ErrDefaultWorkspace
+	}
+	name, err := checkWorkspaceName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	ws, ok := w.byID[id]
+	if !ok {
+		return nil, notFound("workspace " + id)
+	}
+	renamed := &Workspace{ID: ws.ID, Name: name, Created: ws.Created}
+	if err := w.writeMeta(renamed); err != nil {
+		return nil, err
+	}
+	ws.Name = name
+	return ws, nil
+}
+
+// Delete removes a workspace with all its furni, backups and history
+func (w *Workspaces) Delete(id string) error {
+	if id == defaultWorkspaceID {
+		return ErrDefaultWorkspace
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.byID[id]; !ok {
+		return notFound("workspace " + id)
+	}
+	if err := os.RemoveAll(filepath.Join(w.Dir, id)); err != nil {
+		return err
+	}
+	delete(w.byID, id)
+	return nil
+}
+
+// workspaceErrorStatus maps workspace errors to an HTTP status
+func workspaceErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrDefaultWorkspace):
+		return http.StatusForbidden
+	case errors.Is(err, ErrInvalidWorkspaceName):
+		return http.StatusBadRequest
+	}
+	return nitroErrorStatus(err)
+}
+
+// requestWorkspace returns the workspace named by the :ws route parameter,
+// or the default workspace on the unscoped routes. It writes the error
+// response and returns nil when the workspace doesn't exist.
+func requestWorkspace(c *gin.Context) *Workspace {
+	id := c.Param("ws")
+	if id == "" {
+		return workspaces.Default
+	}
+	ws, err := workspaces.Get(id)
+	if err != nil {
+		c.JSON(workspaceErrorStatus(err), gin.H{"error": "Workspace not found: " + id})
+		return nil
+	}
+	return ws
+}
+
+type workspaceRequest struct {
+	Name string `json:"name"`
+}
+
+// listWorkspaces lists every workspace with its furni count and size
+func listWorkspaces(c *gin.Context) {
+	list := []WorkspaceInfo{}
+	for _, ws := range workspaces.List() {
+		info, err := ws.Info()
+		if err != nil {
+			log.Printf("[ERROR] listWorkspaces: error listing %s: %v", ws.ID, err)
+		}
+		list = append(list, info)
+	}
+	c.JSON(http.StatusOK, gin.H{"workspaces": list})
+}
+
+// createWorkspace creates an empty workspace
+func createWorkspace(c *gin.Context) {
+	var req workspaceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ws, err := workspaces.Create(req.Name)
+	if err != nil {
+		log.Printf("[ERROR] createWorkspace: %v", err)
+		c.JSON(workspaceErrorStatus(err), gin.H{"error": "Error creating workspace: " + err.Error()})
+		return
+	}
+
+	log.Printf("[DEBUG] createWorkspace: created workspace %s (%s)", ws.ID, ws.Name)
+	c.JSON(http.StatusCreated, ws)
+}
+
+// renameWorkspace changes the display name of a workspace
+func renameWorkspace(c *gin.Context) {
+	var req workspaceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ws, err := workspaces.Rename(c.Param("ws"), req.Name)
+	if err != nil {
+		log.Printf("[ERROR] renameWorkspace: %v", err)
+		c.JSON(workspaceErrorStatus(err), gin.H{"error": "Error renaming workspace: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, ws)
+}
+
+// deleteWorkspace removes a workspace and the renders made from it
+func deleteWorkspace(c *gin.Context) {
+	ws := requestWorkspace(c)
+	if ws == nil {
+		return
+	}
+
+	if err := workspaces.Delete(ws.ID); err != nil {
+		log.Printf("[ERROR] deleteWorkspace: %v", err)
+		c.JSON(workspaceErrorStatus(err), gin.H{"error": "Error deleting workspace: " + err.Error()})
+		return
+	}
+	renderCache.InvalidateWorkspace(ws)
+
+	log.Printf("[DEBUG] deleteWorkspace: deleted workspace %s (%s)", ws.ID, ws.Name)
+	c.JSON(http.StatusOK, gin.H{"message": "Workspace deleted successfully", "id": ws.ID})
+}
+
+// exportWorkspace streams every .nitro file of a workspace as a zip
+func exportWorkspace(c *gin.Context) {
+	ws := requestWorkspace(c)
+	if ws == nil {
+		return
+	}
+
+	entries, err := ws.Store.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error listing workspace: " + err.Error()})
+		return
+	}
+
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", "attachment; filename=\"workspace_"+ws.ID+".zip\"")
+	c.Status(http.StatusOK)
+
+	zw := zip.NewWriter(c.Writer)
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name, ".nitro") {
+			continue
+		}
+		data, err := ws.Store.Get(entry.Name)
+		if err != nil {
+			// Headers are already sent, all we can do is leave the file out
+			log.Printf("[ERROR] exportWorkspace: error reading %s: %v", entry.Name, err)
+			continue
+		}
+		// Nitro entries are already zlib compressed, so store them as they are
+		w, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     entry.Name,
+			Method:   zip.Store,
+			Modified: entry.ModTime,
+		})
+		if err == nil {
+			_, err = w.Write(data)
+		}
+		if err != nil {
+			log.Printf("[ERROR] exportWorkspace: error writing zip: %v", err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		log.Printf("[ERROR] exportWorkspace: error writing zip: %v", err)
+	}
+}
@@ -7,7 +7,7 @@ export const useFileOperations = () => {
   const [success, setSuccess] = useState('')
   const [isDragOver, setIsDragOver] = useState(false)
 
-  const handleFileUpload = async (file, autoRender = false) => {
+  const handleFileUpload = async (file, autoRender = false, onConflict = 'reject') => {
     if (!file || !file.name.endsWith('.nitro')) {
       setError('Please select a valid .nitro file')
       return
@@ -15,6 +15,7 @@ export const useFileOperations = () => {
 
     const formData = new FormData()
     formData.append('file', file)
+    formData.append('on_conflict', onConflict)
 
     try {
       setLoading(true)
@@ -27,10 +28,20 @@ export const useFileOperations = () => {
 
       const result = await response.json()
       
+      if (response.status === 409) {
+        // Someone already uploaded a furni with this name
+        const overwrite = window.confirm(
+          `${result.error}. Overwrite it? Choose Cancel to keep both.`
+        )
+        return handleFileUpload(file, autoRender, overwrite ? 'overwrite' : 'rename')
+      }
+
       if (response.ok) {
-        setFileInfo(result.info)
+        // The stored name can differ from the furni name when it was renamed on conflict
+        const info = { ...result.info, name: result.filename.replace(/\.nitro$/, '') }
+        setFileInfo(info)
         setSuccess('File uploaded successfully')
-        return result.info
+        return info
       } else {
         setError(result.error || 'Error uploading file')
         return null
@@ -29,7 +29,11 @@ export const useGifRenderer = (setSuccess, setError) => {
       if (response.ok) {
         const gifUrlWithTimestamp = result.gif_url + '?t=' + Date.now()
         setRenderedGif(gifUrlWithTimestamp)
-        setSuccess('GIF renderizado correctamente')
+        if (result.warnings && result.warnings.length > 0) {
+          setSuccess('GIF renderizado con avisos: ' + result.warnings.join(', '))
+        } else {
+          setSuccess('GIF renderizado correctamente')
+        }
       } else {
         setError(result.error || 'Error rendering')
       }